@@ -0,0 +1,272 @@
+// Command redir is a transparent proxy for linux gateways. Connections that
+// iptables/nftables REDIRECT to the local port are forwarded to a shadowsocks
+// server, so LAN clients need no per-application proxy settings.
+//
+// Example rules for a router whose LAN interface is br0:
+//
+//	iptables -t nat -N SS
+//	iptables -t nat -A SS -d <server ip> -j RETURN
+//	iptables -t nat -A SS -d 10.0.0.0/8 -j RETURN
+//	iptables -t nat -A SS -d 172.16.0.0/12 -j RETURN
+//	iptables -t nat -A SS -d 192.168.0.0/16 -j RETURN
+//	iptables -t nat -A SS -p tcp -j REDIRECT --to-ports 1080
+//	iptables -t nat -A PREROUTING -i br0 -p tcp -j SS
+//
+// UDP is relayed with -u, using TPROXY (the server must support the
+// shadowsocks UDP relay):
+//
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//	iptables -t mangle -A PREROUTING -i br0 -p udp -j TPROXY --on-port 1080 --tproxy-mark 1
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+var debug ss.DebugLog
+
+func handleConnection(conn *net.TCPConn, server string, cipher *ss.Cipher) {
+	defer conn.Close()
+	rawaddr, err := ss.GetOriginalDst(conn)
+	if err != nil {
+		log.Println("error getting original destination", conn.RemoteAddr(), err)
+		return
+	}
+	remote, err := ss.DialWithRawAddr(rawaddr, server, cipher.Copy())
+	if err != nil {
+		log.Println("error connecting to shadowsocks server:", err)
+		return
+	}
+	if debug {
+		debug.Printf("piping %s<->%s via %s\n", conn.RemoteAddr(), conn.LocalAddr(), server)
+	}
+	go ss.PipeThenClose(conn, remote)
+	ss.PipeThenClose(remote, conn)
+}
+
+func runTCP(addr, server string, cipher *ss.Cipher) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("error listening %v: %v\n", addr, err)
+		os.Exit(1)
+	}
+	log.Printf("redir listening tcp %v ...\n", addr)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("accept:", err)
+				return
+			}
+			// Out of file descriptors or the like, give it a moment.
+			delay = backoff(delay)
+			log.Printf("accept: %v, retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handleConnection(conn.(*net.TCPConn), server, cipher)
+	}
+}
+
+// backoff returns how long to wait after another failure in a row, last
+// having been the previous wait: from 5ms doubling up to a second, as
+// net/http does.
+func backoff(last time.Duration) time.Duration {
+	if last == 0 {
+		return 5 * time.Millisecond
+	}
+	if last *= 2; last > time.Second {
+		last = time.Second
+	}
+	return last
+}
+
+// udpNAT keeps one server-facing socket per (client, original destination)
+// pair, so replies can be routed back to the right client.
+type udpNAT struct {
+	sync.Mutex
+	conns map[string]*net.UDPConn
+}
+
+func runUDP(addr, server string, cipher *ss.Cipher, timeout time.Duration) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		log.Printf("error resolving server %v: %v\n", server, err)
+		os.Exit(1)
+	}
+	ln, err := ss.ListenTProxyUDP(addr)
+	if err != nil {
+		log.Printf("error listening udp %v: %v\n", addr, err)
+		os.Exit(1)
+	}
+	log.Printf("redir listening udp %v ...\n", addr)
+	nat := &udpNAT{conns: map[string]*net.UDPConn{}}
+	buf := make([]byte, 64*1024)
+	var delay time.Duration
+	for {
+		n, src, dst, err := ss.ReadFromTProxy(ln, buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("udp read:", err)
+				return
+			}
+			delay = backoff(delay)
+			debug.Printf("udp read: %v, retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		payload := append(ss.RawAddrFromIP(dst.IP, dst.Port), buf[:n]...)
+		pkt, err := ss.EncryptPacket(cipher, payload)
+		if err != nil {
+			log.Println("udp encrypt:", err)
+			continue
+		}
+		key := src.String() + "|" + dst.String()
+		nat.Lock()
+		rc, ok := nat.conns[key]
+		if !ok {
+			rc, err = net.DialUDP("udp", nil, serverAddr)
+			if err != nil {
+				nat.Unlock()
+				log.Println("udp dial server:", err)
+				continue
+			}
+			nat.conns[key] = rc
+			go relayUDPReplies(nat, key, rc, src, dst, cipher, timeout)
+		}
+		nat.Unlock()
+		if _, err = rc.Write(pkt); err != nil {
+			debug.Println("udp write:", err)
+		}
+	}
+}
+
+func relayUDPReplies(nat *udpNAT, key string, rc *net.UDPConn, src, dst *net.UDPAddr, cipher *ss.Cipher, timeout time.Duration) {
+	defer func() {
+		nat.Lock()
+		delete(nat.conns, key)
+		nat.Unlock()
+		rc.Close()
+	}()
+	reply, err := ss.DialTProxyReply(dst)
+	if err != nil {
+		log.Printf("udp reply socket for %v: %v\n", dst, err)
+		return
+	}
+	defer reply.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		rc.SetReadDeadline(time.Now().Add(timeout))
+		n, err := rc.Read(buf)
+		if err != nil {
+			return
+		}
+		payload, err := ss.DecryptPacket(cipher, buf[:n])
+		if err != nil {
+			debug.Println("udp decrypt:", err)
+			continue
+		}
+		_, data, err := ss.SplitRawAddr(payload)
+		if err != nil {
+			debug.Println("udp reply:", err)
+			continue
+		}
+		if _, err = reply.WriteToUDP(data, src); err != nil {
+			debug.Println("udp reply write:", err)
+		}
+	}
+}
+
+// startPlugin runs plugin between us and server, returning the loopback
+// address to connect to instead. The plugin is stopped when we're killed.
+func startPlugin(plugin, opts, server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", err
+	}
+	local, err := ss.FreeLoopbackPort()
+	if err != nil {
+		return "", err
+	}
+	p, err := ss.StartPlugin(plugin, opts, host, port, "127.0.0.1", local)
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		p.Stop()
+		os.Exit(0)
+	}()
+	log.Printf("plugin %s forwarding 127.0.0.1:%s to %s\n", plugin, local, server)
+	return net.JoinHostPort("127.0.0.1", local), nil
+}
+
+func main() {
+	log.SetOutput(os.Stdout)
+	var local, server, password, method, plugin, pluginOpts string
+	var timeout int
+	var udp, printVer bool
+
+	flag.BoolVar(&printVer, "v", false, "show version and about")
+	flag.StringVar(&local, "l", ":1080", "local address redirected connections arrive at")
+	flag.StringVar(&server, "s", "", "shadowsocks server address, host:port")
+	flag.StringVar(&password, "k", "", "password")
+	flag.StringVar(&method, "m", "aes-128-cfb", "encryption method, append -auth for one time auth")
+	flag.IntVar(&timeout, "t", 300, "timeout in seconds, default 300")
+	flag.BoolVar(&udp, "u", false, "also relay udp diverted by TPROXY")
+	flag.StringVar(&plugin, "plugin", "", "SIP003 plugin executable, e.g. obfs-local")
+	flag.StringVar(&pluginOpts, "plugin-opts", "", "options passed to the plugin")
+	flag.BoolVar((*bool)(&debug), "d", false, "print debug message")
+	flag.Parse()
+
+	if printVer {
+		ss.PrintVersion()
+		os.Exit(0)
+	}
+	if server == "" || password == "" {
+		fmt.Fprintln(os.Stderr, "server address and password are required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	ss.SetDebug(debug)
+	ss.SetTimeout(timeout)
+	if err := ss.CheckCipherMethod(strings.TrimSuffix(method, "-auth")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cipher, err := ss.NewCipher(method, password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if udp {
+		// Plugins only carry tcp, udp always goes to the server directly.
+		go runUDP(local, server, cipher, time.Duration(timeout)*time.Second)
+	}
+	tcpServer := server
+	if plugin != "" {
+		if tcpServer, err = startPlugin(plugin, pluginOpts, server); err != nil {
+			fmt.Fprintln(os.Stderr, "error starting plugin:", err)
+			os.Exit(1)
+		}
+	}
+	runTCP(local, tcpServer, cipher)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// bans holds the client networks refused on every port.
+var bans = ss.NewBanList(ss.DefaultBanConfig)
+
+func banConfig(config *ss.Config) (ss.BanConfig, error) {
+	cfg := ss.DefaultBanConfig
+	if config.BanFailures != 0 {
+		cfg.MaxFailures = config.BanFailures
+	}
+	if config.BanWindow > 0 {
+		cfg.Window = time.Duration(config.BanWindow) * time.Second
+	}
+	if config.BanTime > 0 {
+		cfg.BanTime = time.Duration(config.BanTime) * time.Second
+	}
+	if config.BanPrefix4 != 0 {
+		cfg.IPv4Prefix = config.BanPrefix4
+	}
+	if config.BanPrefix6 != 0 {
+		cfg.IPv6Prefix = config.BanPrefix6
+	}
+	if cfg.IPv4Prefix < 8 || cfg.IPv4Prefix > 32 {
+		return cfg, fmt.Errorf("ban_prefix4 %d out of range 8-32", cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix < 16 || cfg.IPv6Prefix > 128 {
+		return cfg, fmt.Errorf("ban_prefix6 %d out of range 16-128", cfg.IPv6Prefix)
+	}
+	for _, s := range config.BanTrusted {
+		n, err := ss.ParseCIDR(s)
+		if err != nil {
+			return cfg, fmt.Errorf("ban_trusted: %v", err)
+		}
+		cfg.Trusted = append(cfg.Trusted, n)
+	}
+	if config.Plugin != "" || config.Transport == "ws" {
+		// Every client appears to come from the plugin or the proxy in
+		// front of the ws transport.
+		cfg.MaxFailures = -1
+	}
+	return cfg, nil
+}
+
+// loadBans applies the ban settings of config, restoring saved bans when
+// starting.
+func loadBans(config *ss.Config, start bool) error {
+	cfg, err := banConfig(config)
+	if err != nil {
+		return err
+	}
+	bans.Configure(cfg)
+	if start && config.BanFile != "" {
+		return bans.Load(config.BanFile)
+	}
+	return nil
+}
+
+// saving serializes writes of the ban file.
+var saving sync.Mutex
+
+func saveBans() {
+	saving.Lock()
+	defer saving.Unlock()
+	file := currentConfig().BanFile
+	if file == "" {
+		return
+	}
+	if err := bans.Save(file); err != nil {
+		log.Printf("error saving bans to %s: %v\n", file, err)
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// handshakeFailed counts a failed handshake from client against it.
+func handshakeFailed(client net.Addr, port string) {
+	ip := addrIP(client)
+	if bans.Fail(ip) {
+		log.Printf("banning %s after repeated handshake failures, last on port %s\n", ip, port)
+		go saveBans()
+	}
+}
+
+// banned tells whether a connection from client must be refused.
+func banned(client net.Addr) bool {
+	return bans.Banned(addrIP(client))
+}
+
+// banPage lists the bans.
+func banPage(w http.ResponseWriter, req *http.Request) {
+	str := "Banned networks:\n\n"
+	for _, b := range bans.List() {
+		str += fmt.Sprintf("%s\tuntil %s\n", b.Net, b.Until.Format("2006-01-02 15:04:05"))
+	}
+	io.WriteString(w, str)
+}
+
+// banHandler bans ?addr=, an ip address or network, for ?time= seconds or
+// the configured ban time.
+func banHandler(w http.ResponseWriter, req *http.Request) {
+	var d time.Duration
+	if t := req.FormValue("time"); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs <= 0 {
+			http.Error(w, "bad time", http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	cidr, err := bans.Ban(req.FormValue("addr"), d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("banned %s by admin request\n", cidr)
+	go saveBans()
+	io.WriteString(w, "OK")
+}
+
+func unbanHandler(w http.ResponseWriter, req *http.Request) {
+	addr := req.FormValue("addr")
+	if !bans.Unban(addr) {
+		http.Error(w, "not banned", http.StatusNotFound)
+		return
+	}
+	log.Printf("unbanned %s by admin request\n", addr)
+	go saveBans()
+	io.WriteString(w, "OK")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	billingInterval = 10 * time.Minute
+	// MySQL advisory lock held by the node running the billing cycle
+	billingLock = "ssgo_billing"
+)
+
+// billingCycles runs the billing cycle every ten minutes or so on leader
+// nodes.
+func billingCycles() {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(billingInterval) / 5))
+		time.Sleep(billingInterval - billingInterval/10 + jitter)
+		if !currentConfig().BillingLeader {
+			continue
+		}
+		n, err := runBilling(time.Now())
+		if err != nil {
+			log.Println("billing cycle:", err)
+		}
+		if n > 0 {
+			log.Printf("billing cycle reset traffic of %d users\n", n)
+			// Bring back users that were over their quota.
+			reloadConfig(true)
+		}
+	}
+}
+
+// periodStart returns when the current billing period of a user began: the
+// last reset day of the month (the month's last day if it's shorter) for
+// monthly plans, or the last multiple of period days after the previous
+// reset. The zero time means the user is never reset.
+func periodStart(now time.Time, resetDay, periodDays int, lastReset time.Time) time.Time {
+	switch {
+	case resetDay > 0:
+		y, m, _ := now.Date()
+		start := monthDay(y, m, resetDay, now.Location())
+		if start.After(now) {
+			start = monthDay(y, m-1, resetDay, now.Location())
+		}
+		return start
+	case periodDays > 0:
+		if lastReset.Unix() <= 0 {
+			return now
+		}
+		period := time.Duration(periodDays) * 24 * time.Hour
+		return lastReset.Add(now.Sub(lastReset) / period * period)
+	}
+	return time.Time{}
+}
+
+// monthDay returns the start of day of month m, or of its last day if it
+// has fewer days.
+func monthDay(y int, m time.Month, day int, loc *time.Location) time.Time {
+	if last := time.Date(y, m+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+		day = last
+	}
+	return time.Date(y, m, day, 0, 0, 0, 0, loc)
+}
+
+// runBilling archives and resets the traffic of users whose period ended,
+// if no other node is doing so, and returns how many were reset.
+func runBilling(now time.Time) (int, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var got sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", billingLock).Scan(&got); err != nil {
+		return 0, err
+	}
+	if got.Int64 != 1 {
+		debug.Println("billing cycle running on another node")
+		return 0, nil
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", billingLock)
+
+	type due struct {
+		id         int64
+		start, end int64
+	}
+	var users []due
+	rows, err := conn.QueryContext(ctx, "SELECT id,reset_day,reset_period,last_reset FROM ss_user WHERE reset_day > 0 OR reset_period > 0")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id, last int64
+		var day, period int
+		if err = rows.Scan(&id, &day, &period, &last); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		start := periodStart(now, day, period, time.Unix(last, 0))
+		if !start.IsZero() && last < start.Unix() {
+			users = append(users, due{id, last, start.Unix()})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, u := range users {
+		if u.start == 0 {
+			// Billed from now on, what was counted before is left alone.
+			if err = initUser(ctx, conn, u.id, u.end); err != nil {
+				return n, err
+			}
+			continue
+		}
+		ok, err := resetUser(ctx, conn, u.id, u.start, u.end)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// initUser starts the periods of a user never reset at start.
+func initUser(ctx context.Context, conn *sql.Conn, id, start int64) error {
+	_, err := conn.ExecContext(ctx, "UPDATE ss_user SET last_reset = ? WHERE id = ? AND last_reset = 0", start, id)
+	return err
+}
+
+// resetUser moves the traffic of a user's period ending at end into the
+// history and zeroes the counters, in one transaction so traffic saved by
+// nodes meanwhile lands in either period, never in none.
+func resetUser(ctx context.Context, conn *sql.Conn, id, start, end int64) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var u, d, ue, de, limits, last int64
+	err = tx.QueryRowContext(ctx, "SELECT u,d,ue,de,limits,last_reset FROM ss_user WHERE id = ? FOR UPDATE", id).
+		Scan(&u, &d, &ue, &de, &limits, &last)
+	if err == sql.ErrNoRows || err == nil && last != start {
+		// deleted, or reset by someone else since we looked
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO ss_user_history (user_id,period_start,period_end,u,d,ue,de,limits) VALUES (?,?,?,?,?,?,?,?)",
+		id, start, end, u, d, ue, de, limits); err != nil {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE ss_user SET u = 0, d = 0, ue = 0, de = 0, last_reset = ?, active = IF(expire = 0 OR expire > UNIX_TIMESTAMP(), 1, active) WHERE id = ?",
+		end, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(y int, m time.Month, d, h int) time.Time {
+	return time.Date(y, m, d, h, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodStart(t *testing.T) {
+	last := date(2026, 1, 1, 0)
+	for _, c := range []struct {
+		name         string
+		now          time.Time
+		day, period  int
+		last, expect time.Time
+	}{
+		{"monthly", date(2026, 3, 20, 12), 15, 0, last, date(2026, 3, 15, 0)},
+		{"monthly on the day", date(2026, 3, 15, 0), 15, 0, last, date(2026, 3, 15, 0)},
+		{"monthly before the day", date(2026, 3, 10, 12), 15, 0, last, date(2026, 2, 15, 0)},
+		{"january rolls back a year", date(2026, 1, 3, 12), 5, 0, last, date(2025, 12, 5, 0)},
+		{"clamped to february", date(2026, 3, 10, 12), 31, 0, last, date(2026, 2, 28, 0)},
+		{"clamped in a leap year", date(2024, 2, 29, 12), 30, 0, last, date(2024, 2, 29, 0)},
+		{"clamped this month", date(2026, 4, 30, 12), 31, 0, last, date(2026, 4, 30, 0)},
+		{"first period", date(2026, 1, 20, 12), 0, 30, last, last},
+		{"period boundary", date(2026, 1, 31, 0), 0, 30, last, date(2026, 1, 31, 0)},
+		{"several periods", date(2026, 3, 15, 12), 0, 30, last, date(2026, 3, 2, 0)},
+		{"never reset", date(2026, 3, 15, 12), 0, 30, time.Unix(0, 0), date(2026, 3, 15, 12)},
+		{"no plan", date(2026, 3, 15, 12), 0, 0, last, time.Time{}},
+	} {
+		if got := periodStart(c.now, c.day, c.period, c.last); !got.Equal(c.expect) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.expect)
+		}
+	}
+}
+
+func TestMonthDay(t *testing.T) {
+	for _, c := range []struct {
+		y      int
+		m      time.Month
+		day    int
+		expect time.Time
+	}{
+		{2026, 3, 15, date(2026, 3, 15, 0)},
+		{2026, 2, 31, date(2026, 2, 28, 0)},
+		{2024, 2, 31, date(2024, 2, 29, 0)},
+		{2026, 4, 31, date(2026, 4, 30, 0)},
+		{2026, 0, 31, date(2025, 12, 31, 0)},
+		{2026, 0, 5, date(2025, 12, 5, 0)},
+	} {
+		if got := monthDay(c.y, c.m, c.day, time.UTC); !got.Equal(c.expect) {
+			t.Errorf("monthDay(%d, %d, %d): got %v, want %v", c.y, c.m, c.day, got, c.expect)
+		}
+	}
+}
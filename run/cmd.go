@@ -3,6 +3,7 @@ package main
 import (
     "fmt"
     "github.com/realpg/ssgo/utils"
+    ss "github.com/realpg/ssgo/shadowsocks"
 )
 
 func initDatabase() int {
@@ -12,6 +13,16 @@ func initDatabase() int {
 		return 1
 	}
 	defer tx.Rollback()
+	_,err = tx.Exec("DROP TABLE IF EXISTS ss_user_history")
+	if err!=nil {
+		fmt.Printf("Error while initDatabase. droping user history [%s]",err.Error())
+		return 1
+	}
+	_,err = tx.Exec("DROP TABLE IF EXISTS ss_traffic")
+	if err!=nil {
+		fmt.Printf("Error while initDatabase. droping traffic [%s]",err.Error())
+		return 1
+	}
 	_,err = tx.Exec("DROP TABLE IF EXISTS ss_detail")
 	if err!=nil {
 		fmt.Printf("Error while initDatabase. droping detail [%s]",err.Error())
@@ -37,12 +48,12 @@ func initDatabase() int {
 		fmt.Printf("Error while initDatabase. creating admin [%s]",err.Error())
 		return 1
 	}
-	_,err = tx.Exec("CREATE TABLE `ss_server` ( `id` int(10) UNSIGNED NOT NULL, `name` varchar(20) NOT NULL, `addr` varchar(100) NOT NULL, PRIMARY KEY (`id`), UNIQUE KEY `name` (`name`)) ENGINE=InnoDB DEFAULT CHARSET=utf8;")
+	_,err = tx.Exec("CREATE TABLE `ss_server` ( `id` int(10) UNSIGNED NOT NULL, `name` varchar(20) NOT NULL, `addr` varchar(100) NOT NULL, `relay_addr` varchar(100) NOT NULL DEFAULT '', `relay_mode` varchar(10) NOT NULL DEFAULT '', `relay_method` varchar(20) NOT NULL DEFAULT '', `relay_passwd` varchar(128) NOT NULL DEFAULT '', PRIMARY KEY (`id`), UNIQUE KEY `name` (`name`)) ENGINE=InnoDB DEFAULT CHARSET=utf8;")
 	if err!=nil {
 		fmt.Printf("Error while initDatabase. creating server [%s]",err.Error())
 		return 1
 	}
-	_,err = tx.Exec("CREATE TABLE `ss_user` ( `id` int(10) UNSIGNED NOT NULL AUTO_INCREMENT, `name` varchar(20) NOT NULL, `email` varchar(200) NOT NULL, `password` varchar(128) NOT NULL, `port` smallint(5) UNSIGNED NOT NULL, `passwd` varchar(32) NOT NULL, `u` bigint(20) UNSIGNED NOT NULL, `d` bigint(20) NOT NULL, `ue` bigint(20) UNSIGNED NOT NULL, `de` bigint(20) UNSIGNED NOT NULL, `limits` bigint(20) UNSIGNED NOT NULL, `t` int(10) UNSIGNED NOT NULL, `active` tinyint(3) UNSIGNED NOT NULL, PRIMARY KEY (`id`),UNIQUE KEY `port` (`port`) USING BTREE, UNIQUE KEY `email` (`email`),KEY `active` (`active`) USING HASH) ENGINE=InnoDB DEFAULT CHARSET=utf8;")
+	_,err = tx.Exec("CREATE TABLE `ss_user` ( `id` int(10) UNSIGNED NOT NULL AUTO_INCREMENT, `name` varchar(20) NOT NULL, `email` varchar(200) NOT NULL, `password` varchar(128) NOT NULL, `port` smallint(5) UNSIGNED NOT NULL, `passwd` varchar(32) NOT NULL, `u` bigint(20) UNSIGNED NOT NULL, `d` bigint(20) NOT NULL, `ue` bigint(20) UNSIGNED NOT NULL, `de` bigint(20) UNSIGNED NOT NULL, `limits` bigint(20) UNSIGNED NOT NULL, `t` int(10) UNSIGNED NOT NULL, `active` tinyint(3) UNSIGNED NOT NULL, `policy` varchar(32) NOT NULL DEFAULT '', `egress_ip` varchar(100) NOT NULL DEFAULT '', `obfs` varchar(8) NOT NULL DEFAULT '', `method` varchar(32) NOT NULL DEFAULT '', `expire` int(10) UNSIGNED NOT NULL DEFAULT 0, `reset_day` tinyint(3) UNSIGNED NOT NULL DEFAULT 0, `reset_period` smallint(5) UNSIGNED NOT NULL DEFAULT 0, `last_reset` int(10) UNSIGNED NOT NULL DEFAULT 0, PRIMARY KEY (`id`),UNIQUE KEY `port` (`port`) USING BTREE, UNIQUE KEY `email` (`email`),KEY `active` (`active`) USING HASH) ENGINE=InnoDB DEFAULT CHARSET=utf8;")
 	if err!=nil {
 		fmt.Printf("Error while initDatabase. creating user [%s]",err.Error())
 		return 1
@@ -52,6 +63,13 @@ func initDatabase() int {
 		fmt.Printf("Error while initDatabase. creating detail [%s]",err.Error())
 		return 1
 	}
+	for _, stmt := range ss.SchemaTables {
+		_,err = tx.Exec(stmt)
+		if err!=nil {
+			fmt.Printf("Error while initDatabase. creating tables [%s]",err.Error())
+			return 1
+		}
+	}
 	tx.Exec("INSERT INTO ss_admin (username,password) VALUES (?,?)","admin", utils.G("admin","admin123123"))
 	err = tx.Commit()
 	fmt.Println("Init database successfully! Exit!")
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// how often loaded users are checked for expiry, between reloads
+const expiryCheckInterval = 10 * time.Second
+
+// expiry is when the loaded users expire, by port. It's kept apart from
+// config so the checks don't race with reloads replacing it.
+var expiry struct {
+	sync.Mutex
+	until map[string]int64
+	uid   map[string]string
+}
+
+// setExpiry takes the expiry of the users of config.
+func setExpiry(config *ss.Config) {
+	expiry.Lock()
+	expiry.until = config.PortExpire
+	expiry.uid = config.PortUID
+	expiry.Unlock()
+}
+
+// dropExpired leaves out of config the users that expired by now. The
+// database goes by its own clock, so it may still have them active.
+func dropExpired(config *ss.Config, now time.Time) {
+	for port, until := range config.PortExpire {
+		if now.Unix() >= until {
+			delete(config.PortPassword, port)
+		}
+	}
+}
+
+// expireUsers closes the ports, and the connections on them, of users whose
+// expiry passes. The database marks them inactive on the next reload.
+func expireUsers() {
+	for range time.Tick(expiryCheckInterval) {
+		expirePorts(time.Now())
+	}
+}
+
+func expirePorts(now time.Time) {
+	expiry.Lock()
+	until, uid := expiry.until, expiry.uid
+	expiry.Unlock()
+	for port, t := range until {
+		if now.Unix() < t {
+			continue
+		}
+		if _, ok := passwdManager.get(port); !ok {
+			continue
+		}
+		n := passwdManager.del(port)
+		log.Printf("closed port %s (user %s) and %d connections, expired at %s\n",
+			port, uid[port], n, time.Unix(t, 0).Format("2006-01-02 15:04:05"))
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+func TestExpirePorts(t *testing.T) {
+	cfg := &ss.Config{
+		PortPassword: map[string]string{"10001": "a", "10002": "b", "10003": "c"},
+		PortUID:      map[string]string{"10001": "1", "10002": "2", "10003": "3"},
+		PortExpire:   map[string]int64{"10001": 1000, "10002": 2000},
+	}
+	listeners := make(map[string]net.Listener)
+	for port := range cfg.PortPassword {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[port] = ln
+		passwdManager.add(port, &PortListener{listener: ln, raw: ln})
+	}
+	defer passwdManager.closeAll()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if !trackConn(c1, "10001") {
+		t.Fatal("connection not tracked")
+	}
+	defer untrackConn(c1)
+	setExpiry(cfg)
+
+	expirePorts(time.Unix(1500, 0))
+	if _, ok := passwdManager.get("10001"); ok {
+		t.Error("expired port still served")
+	}
+	if _, err := listeners["10001"].Accept(); err == nil {
+		t.Error("expired port still listening")
+	}
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Error("connection to the expired port left open")
+	}
+	for _, port := range []string{"10002", "10003"} {
+		if _, ok := passwdManager.get(port); !ok {
+			t.Errorf("port %s closed before its expiry", port)
+		}
+	}
+
+	// A reload of users the database still has active leaves them out.
+	dropExpired(cfg, time.Unix(2000, 0))
+	if _, ok := cfg.PortPassword["10003"]; !ok || len(cfg.PortPassword) != 1 {
+		t.Errorf("users left after dropping the expired ones: %v", cfg.PortPassword)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query given to -export-traffic
+var exportQuery string
+
+// trafficHistorySQL returns the statement save2DB uses to add rows, each
+// formatted as (server_id,user_id,hour,u,d,ue,de), to the hourly history.
+func trafficHistorySQL(rows []string) string {
+	return "INSERT INTO ss_traffic (server_id,user_id,hour,u,d,ue,de) VALUES " + strings.Join(rows, ",") +
+		" ON DUPLICATE KEY UPDATE u = u+VALUES(u), d = d+VALUES(d), ue = ue+VALUES(ue), de = de+VALUES(de);"
+}
+
+// trafficQuery selects the history of a user and server, any if zero,
+// from and until the given times, in hourly or daily buckets.
+type trafficQuery struct {
+	user, server int64
+	from, to     time.Time
+	daily        bool
+}
+
+type trafficRow struct {
+	user, server int64
+	start        time.Time
+	u, d, ue, de int64
+}
+
+// parseTrafficQuery reads user, server, from, to and group (hour or day)
+// parameters. Times are unix seconds, or local dates and times like
+// 2006-01-02 or 2006-01-02 15:04, a date for to including the whole day.
+// By default the last day is shown hourly, the last week daily.
+func parseTrafficQuery(v url.Values, now time.Time) (*trafficQuery, error) {
+	q := &trafficQuery{to: now}
+	var err error
+	switch v.Get("group") {
+	case "", "hour":
+	case "day":
+		q.daily = true
+	default:
+		return nil, fmt.Errorf("group must be hour or day, not %s", v.Get("group"))
+	}
+	for _, p := range []struct {
+		name string
+		id   *int64
+	}{{"user", &q.user}, {"server", &q.server}} {
+		if s := v.Get(p.name); s != "" {
+			if *p.id, err = strconv.ParseInt(s, 10, 64); err != nil || *p.id <= 0 {
+				return nil, fmt.Errorf("bad %s %s", p.name, s)
+			}
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.to, err = parseTime(s, true); err != nil {
+			return nil, err
+		}
+	}
+	if s := v.Get("from"); s != "" {
+		if q.from, err = parseTime(s, false); err != nil {
+			return nil, err
+		}
+	} else if q.daily {
+		q.from = dayStart(q.to.AddDate(0, 0, -6))
+	} else {
+		q.from = q.to.Add(-24 * time.Hour)
+	}
+	if !q.from.Before(q.to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	return q, nil
+}
+
+func parseTime(s string, end bool) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("bad time %s", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func dayStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// queryTraffic returns the buckets of q with traffic, by user, server and
+// time. Days are summed up here so they follow the local time zone.
+func queryTraffic(q *trafficQuery) ([]trafficRow, error) {
+	sql := "SELECT user_id,server_id,hour,u,d,ue,de FROM ss_traffic WHERE hour >= ? AND hour < ?"
+	args := []interface{}{q.from.Unix() - q.from.Unix()%3600, q.to.Unix()}
+	if q.user > 0 {
+		sql += " AND user_id = ?"
+		args = append(args, q.user)
+	}
+	if q.server > 0 {
+		sql += " AND server_id = ?"
+		args = append(args, q.server)
+	}
+	rows, err := db.Query(sql+" ORDER BY user_id,server_id,hour", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []trafficRow
+	for rows.Next() {
+		var r trafficRow
+		var hour int64
+		if err = rows.Scan(&r.user, &r.server, &hour, &r.u, &r.d, &r.ue, &r.de); err != nil {
+			return nil, err
+		}
+		r.start = time.Unix(hour, 0)
+		if q.daily {
+			r.start = dayStart(r.start)
+		}
+		if n := len(list) - 1; n >= 0 && list[n].user == r.user && list[n].server == r.server && list[n].start.Equal(r.start) {
+			list[n].u += r.u
+			list[n].d += r.d
+			list[n].ue += r.ue
+			list[n].de += r.de
+			continue
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+func writeTrafficCSV(w io.Writer, q *trafficQuery, list []trafficRow) error {
+	layout := "2006-01-02 15:04"
+	if q.daily {
+		layout = "2006-01-02"
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user_id", "server_id", "start", "u", "d", "ue", "de"})
+	for _, r := range list {
+		cw.Write([]string{
+			strconv.FormatInt(r.user, 10), strconv.FormatInt(r.server, 10), r.start.Format(layout),
+			strconv.FormatInt(r.u, 10), strconv.FormatInt(r.d, 10), strconv.FormatInt(r.ue, 10), strconv.FormatInt(r.de, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// trafficHandler shows the traffic history selected as by
+// parseTrafficQuery, as csv with ?format=csv.
+func trafficHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	q, err := parseTrafficQuery(req.Form, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := queryTraffic(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="traffic.csv"`)
+		writeTrafficCSV(w, q, list)
+		return
+	}
+	layout := "2006-01-02 15:04"
+	if q.daily {
+		layout = "2006-01-02"
+	}
+	str := fmt.Sprintf("Traffic from %s to %s:\n\n", q.from.Format("2006-01-02 15:04"), q.to.Format("2006-01-02 15:04"))
+	for _, r := range list {
+		str += fmt.Sprintf("User: %d\t Server: %d\t %s\t U: %v(%v) D: %v(%v)\n", r.user, r.server, r.start.Format(layout),
+			readable(r.u), readable(r.u+r.ue), readable(r.d), readable(r.d+r.de))
+	}
+	io.WriteString(w, str)
+}
+
+// exportTraffic writes the history selected by query, given as url
+// parameters, to stdout as csv and returns the exit code.
+func exportTraffic(query string) int {
+	v, err := url.ParseQuery(query)
+	if err == nil {
+		var q *trafficQuery
+		if q, err = parseTrafficQuery(v, time.Now()); err == nil {
+			var list []trafficRow
+			if list, err = queryTraffic(q); err == nil {
+				err = writeTrafficCSV(os.Stdout, q, list)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export traffic:", err)
+		return 1
+	}
+	return 0
+}
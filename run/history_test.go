@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		end    bool
+		expect time.Time
+	}{
+		{"1700000000", false, time.Unix(1700000000, 0)},
+		{"1700000000", true, time.Unix(1700000000, 0)},
+		{"2026-03-15 08:30", false, time.Date(2026, 3, 15, 8, 30, 0, 0, time.Local)},
+		{"2026-03-15 08:30", true, time.Date(2026, 3, 15, 8, 30, 0, 0, time.Local)},
+		{"2026-03-15", false, time.Date(2026, 3, 15, 0, 0, 0, 0, time.Local)},
+		{"2026-03-15", true, time.Date(2026, 3, 16, 0, 0, 0, 0, time.Local)},
+		{"2026-12-31", true, time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		got, err := parseTime(c.s, c.end)
+		if err != nil || !got.Equal(c.expect) {
+			t.Errorf("parseTime(%q, %v) = %v, %v; want %v", c.s, c.end, got, err, c.expect)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "2026-13-01", "2026-03-15T08:30"} {
+		if _, err := parseTime(s, false); err == nil {
+			t.Errorf("parseTime(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParseTrafficQuery(t *testing.T) {
+	now := time.Date(2026, 3, 15, 10, 30, 0, 0, time.Local)
+	for _, c := range []struct {
+		query  string
+		expect trafficQuery
+	}{
+		{"", trafficQuery{from: now.Add(-24 * time.Hour), to: now}},
+		{"group=hour&user=3", trafficQuery{user: 3, from: now.Add(-24 * time.Hour), to: now}},
+		{"group=day&server=2", trafficQuery{server: 2, from: time.Date(2026, 3, 9, 0, 0, 0, 0, time.Local), to: now, daily: true}},
+		{"from=2026-03-01&to=2026-03-07&group=day", trafficQuery{
+			from: time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), to: time.Date(2026, 3, 8, 0, 0, 0, 0, time.Local), daily: true}},
+		{"to=1700000000", trafficQuery{from: time.Unix(1700000000-86400, 0), to: time.Unix(1700000000, 0)}},
+	} {
+		v, _ := url.ParseQuery(c.query)
+		q, err := parseTrafficQuery(v, now)
+		if err != nil {
+			t.Errorf("%q: %v", c.query, err)
+			continue
+		}
+		if q.user != c.expect.user || q.server != c.expect.server || q.daily != c.expect.daily ||
+			!q.from.Equal(c.expect.from) || !q.to.Equal(c.expect.to) {
+			t.Errorf("%q: got %+v, want %+v", c.query, *q, c.expect)
+		}
+	}
+	for _, query := range []string{
+		"group=week", "user=abc", "user=0", "server=-1", "from=never",
+		"to=soon", "from=2026-03-08&to=2026-03-01", "from=1700000000&to=1700000000",
+	} {
+		v, _ := url.ParseQuery(query)
+		if _, err := parseTrafficQuery(v, now); err == nil {
+			t.Errorf("%q accepted", query)
+		}
+	}
+}
+
+func TestWriteTrafficCSV(t *testing.T) {
+	list := []trafficRow{
+		{user: 1, server: 2, start: time.Date(2026, 3, 15, 8, 0, 0, 0, time.Local), u: 10, d: 20, ue: 3, de: 4},
+		{user: 5, server: 2, start: time.Date(2026, 3, 15, 9, 0, 0, 0, time.Local), u: 1 << 40, d: 0, ue: 0, de: 7},
+	}
+	var b bytes.Buffer
+	if err := writeTrafficCSV(&b, &trafficQuery{}, list); err != nil {
+		t.Fatal(err)
+	}
+	expect := "user_id,server_id,start,u,d,ue,de\n" +
+		"1,2,2026-03-15 08:00,10,20,3,4\n" +
+		"5,2,2026-03-15 09:00,1099511627776,0,0,7\n"
+	if b.String() != expect {
+		t.Errorf("hourly: got\n%s\nwant\n%s", b.String(), expect)
+	}
+
+	b.Reset()
+	if err := writeTrafficCSV(&b, &trafficQuery{daily: true}, list[:1]); err != nil {
+		t.Fatal(err)
+	}
+	expect = "user_id,server_id,start,u,d,ue,de\n1,2,2026-03-15,10,20,3,4\n"
+	if b.String() != expect {
+		t.Errorf("daily: got\n%s\nwant\n%s", b.String(), expect)
+	}
+}
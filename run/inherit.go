@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// Environment a parent passes its sockets to an upgraded child with: the
+// names of the files following stdio, as tcp:port, udp:port or admin, and
+// the descriptor to report readiness on.
+const (
+	envListeners = "SSGO_LISTENERS"
+	envReadyFD   = "SSGO_READY_FD"
+)
+
+var inherited struct {
+	sync.Mutex
+	files map[string]*os.File
+}
+
+// loadInherited picks up the sockets passed by the parent, if we were
+// started by an upgrade.
+func loadInherited() {
+	names := os.Getenv(envListeners)
+	os.Unsetenv(envListeners)
+	if names == "" {
+		return
+	}
+	inherited.files = make(map[string]*os.File)
+	for i, name := range strings.Split(names, ",") {
+		inherited.files[name] = os.NewFile(uintptr(3+i), name)
+	}
+	log.Printf("inherited %d sockets from the previous process\n", len(inherited.files))
+}
+
+func takeInherited(name string) *os.File {
+	inherited.Lock()
+	defer inherited.Unlock()
+	f := inherited.files[name]
+	delete(inherited.files, name)
+	return f
+}
+
+// inheritedListener returns the listener passed as name, if any.
+func inheritedListener(name string) net.Listener {
+	f := takeInherited(name)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		log.Printf("error using inherited %s: %v\n", name, err)
+		return nil
+	}
+	return ln
+}
+
+// inheritedPacketConn returns the packet socket passed as name, if any.
+func inheritedPacketConn(name string) net.PacketConn {
+	f := takeInherited(name)
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		log.Printf("error using inherited %s: %v\n", name, err)
+		return nil
+	}
+	return pc
+}
+
+// closeInherited closes the passed sockets of ports that are gone from the
+// config.
+func closeInherited(config *ss.Config) {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for name, f := range inherited.files {
+		_, port, _ := strings.Cut(name, ":")
+		if _, ok := config.PortPassword[port]; ok {
+			continue
+		}
+		f.Close()
+		delete(inherited.files, name)
+	}
+}
+
+// fileOf returns a duplicate of the socket of a listener or packet conn.
+func fileOf(sock interface{}) (*os.File, error) {
+	f, ok := sock.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't pass a %T", sock)
+	}
+	return f.File()
+}
+
+// notifyReady tells the parent we're serving, so it can stop.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	os.Unsetenv(envReadyFD)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
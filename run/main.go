@@ -10,7 +10,6 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
@@ -43,6 +42,10 @@ var debug ss.DebugLog
 var db *sql.DB
 var dbfile *os.File
 
+// errBadRequest is a request header that didn't decrypt to anything valid,
+// as when the client has the wrong password.
+var errBadRequest = errors.New("bad request")
+
 func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	ss.SetReadTimeout(conn)
 
@@ -50,12 +53,37 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	// request size (when addrType is 3, domain name has at most 256 bytes)
 	// 1(addrType) + 1(lenByte) + 256(max length address) + 2(port) + 10(hmac-sha1)
 	buf := make([]byte, 270)
+	host, reqEnd, err := readAddr(conn, buf)
+	if err != nil {
+		return
+	}
+	addrType := buf[idType]
+	// if specified one time auth enabled, we should verify this
+	if auth || addrType&ss.OneTimeAuthMask > 0 {
+		ota = true
+		if _, err = io.ReadFull(conn, buf[reqEnd:reqEnd+lenHmacSha1]); err != nil {
+			return
+		}
+		iv := conn.GetIv()
+		key := conn.GetKey()
+		actualHmacSha1Buf := ss.HmacSha1(append(iv, key...), buf[:reqEnd])
+		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
+			err = fmt.Errorf("%w: verify one time auth failed, iv=%v key=%v data=%v", errBadRequest, iv, key, buf[:reqEnd])
+			return
+		}
+	}
+	return
+}
+
+// readAddr reads a shadowsocks address from r into buf, returning it as
+// host:port and the length of the address in buf.
+func readAddr(r io.Reader, buf []byte) (host string, reqEnd int, err error) {
 	// read till we get possible domain length field
-	if _, err = io.ReadFull(conn, buf[:idType+1]); err != nil {
+	if _, err = io.ReadFull(r, buf[:idType+1]); err != nil {
 		return
 	}
 
-	var reqStart, reqEnd int
+	var reqStart int
 	addrType := buf[idType]
 	switch addrType & ss.AddrMask {
 	case typeIPv4:
@@ -63,16 +91,16 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	case typeIPv6:
 		reqStart, reqEnd = idIP0, idIP0+lenIPv6
 	case typeDm:
-		if _, err = io.ReadFull(conn, buf[idType+1:idDmLen+1]); err != nil {
+		if _, err = io.ReadFull(r, buf[idType+1:idDmLen+1]); err != nil {
 			return
 		}
 		reqStart, reqEnd = idDm0, int(idDm0+buf[idDmLen]+lenDmBase)
 	default:
-		err = fmt.Errorf("addr type %d not supported", addrType&ss.AddrMask)
+		err = fmt.Errorf("%w: addr type %d not supported", errBadRequest, addrType&ss.AddrMask)
 		return
 	}
 
-	if _, err = io.ReadFull(conn, buf[reqStart:reqEnd]); err != nil {
+	if _, err = io.ReadFull(r, buf[reqStart:reqEnd]); err != nil {
 		return
 	}
 
@@ -90,20 +118,6 @@ func getRequest(conn *ss.Conn, auth bool) (host string, ota bool, err error) {
 	// parse port
 	port := binary.BigEndian.Uint16(buf[reqEnd-2 : reqEnd])
 	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
-	// if specified one time auth enabled, we should verify this
-	if auth || addrType&ss.OneTimeAuthMask > 0 {
-		ota = true
-		if _, err = io.ReadFull(conn, buf[reqEnd:reqEnd+lenHmacSha1]); err != nil {
-			return
-		}
-		iv := conn.GetIv()
-		key := conn.GetKey()
-		actualHmacSha1Buf := ss.HmacSha1(append(iv, key...), buf[:reqEnd])
-		if !bytes.Equal(buf[reqEnd:reqEnd+lenHmacSha1], actualHmacSha1Buf) {
-			err = fmt.Errorf("verify one time auth failed, iv=%v key=%v data=%v", iv, key, buf[:reqEnd])
-			return
-		}
-	}
 	return
 }
 
@@ -143,18 +157,26 @@ func handleConnection(conn *ss.Conn, auth bool) {
 	host, ota, err := getRequest(conn, auth)
 	if err != nil {
 		log.Println("error getting request", conn.RemoteAddr(), conn.LocalAddr(), err)
+		if errors.Is(err, errBadRequest) {
+			// Not timeouts or connections closed early, like health checks.
+			handshakeFailed(conn.RemoteAddr(), conn.GetPort())
+		}
+		// Drain the raw connection, the cipher may be out of step already.
+		rejectProbe(conn.Conn, conn.GetPort())
 		return
 	}
-	debug.Println("connecting", host)
-	remote, err := net.Dial("tcp", host)
-	if err != nil {
-		if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
-			// log too many open file error
-			// EMFILE is process reaches open file limits, ENFILE is system limit
-			log.Println("dial error:", err)
-		} else {
-			log.Println("error connecting to:", host, err)
+	if host == ss.MuxAddr {
+		if ota {
+			// The streams would carry ota chunks the session can't strip.
+			log.Println("refused mux session with one time auth from", conn.RemoteAddr())
+			return
 		}
+		handleMux(conn)
+		closed = true
+		return
+	}
+	remote, err := connectTarget(host, conn.GetPort(), conn.RemoteAddr())
+	if err != nil {
 		return
 	}
 	defer func() {
@@ -175,10 +197,83 @@ func handleConnection(conn *ss.Conn, auth bool) {
 	return
 }
 
+// connectTarget dials host for the user of port, connected from client,
+// and logs why if it fails.
+func connectTarget(host, port string, client net.Addr) (net.Conn, error) {
+	debug.Println("connecting", host)
+	remote, err := dialOutbound(host, port)
+	if err != nil {
+		if pe, ok := err.(*policyError); ok {
+			countDialFailure("denied")
+			log.Printf("denied port %s (user %s) from %s to %s by policy %s\n", port, currentConfig().PortUID[port], client, host, pe.policy)
+		} else if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
+			// log too many open file error
+			// EMFILE is process reaches open file limits, ENFILE is system limit
+			log.Println("dial error:", err)
+		} else {
+			class := ss.ClassifyDialError(err)
+			countDialFailure(class)
+			log.Println("error connecting to:", host, class, err)
+		}
+	}
+	return remote, err
+}
+
+// handleMux serves the streams of a multiplexed session until it ends. Each
+// stream starts with the address of its target, like a connection does.
+func handleMux(conn *ss.Conn) {
+	port := conn.GetPort()
+	session := ss.NewMuxServer(conn, time.Duration(currentConfig().Timeout)*time.Second)
+	defer session.Close()
+	debug.Printf("mux session from %s on port %s\n", conn.RemoteAddr(), port)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			debug.Printf("mux session from %s ended: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		go handleMuxStream(stream, port)
+	}
+}
+
+func handleMuxStream(stream *ss.MuxStream, port string) {
+	ss.SetReadTimeout(stream)
+	host, _, err := readAddr(stream, make([]byte, 269))
+	if err != nil {
+		log.Println("error getting mux request", stream.RemoteAddr(), err)
+		stream.Close()
+		return
+	}
+	remote, err := connectTarget(host, port, stream.RemoteAddr())
+	if err != nil {
+		stream.Close()
+		return
+	}
+	go ss.PipeThenCloseStat(stream, remote, port, true)
+	ss.PipeThenCloseStat(remote, stream, port, false)
+}
 
 type PortListener struct {
-	password string
 	listener net.Listener
+	raw      net.Listener   // the socket under listener, handed over on upgrade
+	key      string         // listenKey of the config the listener was built from
+	udp      net.PacketConn // only used by raw relays
+	plugin   *ss.Plugin
+
+	mu       sync.Mutex
+	settings *portSettings
+}
+
+func (pl *PortListener) current() *portSettings {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.settings
+}
+
+func (pl *PortListener) set(s *portSettings) {
+	pl.mu.Lock()
+	pl.settings = s
+	pl.mu.Unlock()
 }
 
 type PasswdManager struct {
@@ -186,10 +281,73 @@ type PasswdManager struct {
 	portListener map[string]*PortListener
 }
 
-func (pm *PasswdManager) add(port, password string, listener net.Listener) {
+func (pm *PasswdManager) add(port string, pl *PortListener) {
+	pm.Lock()
+	pm.portListener[port] = pl
+	pm.Unlock()
+}
+
+func (pm *PasswdManager) addUDP(port string, pc net.PacketConn) {
+	pm.Lock()
+	if pl, ok := pm.portListener[port]; ok {
+		pl.udp = pc
+	}
+	pm.Unlock()
+}
+
+func (pl *PortListener) close() {
+	pl.listener.Close()
+	if pl.udp != nil {
+		pl.udp.Close()
+	}
+	if pl.plugin != nil {
+		pl.plugin.Stop()
+	}
+}
+
+// files duplicates the sockets of every port for a new process, naming
+// them tcp:port and udp:port.
+func (pm *PasswdManager) files() (names []string, files []*os.File, err error) {
+	pm.Lock()
+	defer pm.Unlock()
+	for port, pl := range pm.portListener {
+		f, err := fileOf(pl.raw)
+		if err != nil {
+			return names, files, fmt.Errorf("port %s: %v", port, err)
+		}
+		names = append(names, "tcp:"+port)
+		files = append(files, f)
+		if pl.udp == nil {
+			continue
+		}
+		if f, err = fileOf(pl.udp); err != nil {
+			return names, files, fmt.Errorf("udp port %s: %v", port, err)
+		}
+		names = append(names, "udp:"+port)
+		files = append(files, f)
+	}
+	return names, files, nil
+}
+
+// closeAll stops listening on every port. The ports are closed together
+// and without the lock, as stopping a plugin can take seconds.
+func (pm *PasswdManager) closeAll() {
 	pm.Lock()
-	pm.portListener[port] = &PortListener{password, listener}
+	list := make([]*PortListener, 0, len(pm.portListener))
+	for port, pl := range pm.portListener {
+		list = append(list, pl)
+		delete(pm.portListener, port)
+	}
 	pm.Unlock()
+	var wg sync.WaitGroup
+	for _, pl := range list {
+		wg.Add(1)
+		go func(pl *PortListener) {
+			defer wg.Done()
+			pl.close()
+		}(pl)
+	}
+	wg.Wait()
 }
 
 func (pm *PasswdManager) get(port string) (pl *PortListener, ok bool) {
@@ -199,78 +357,178 @@ func (pm *PasswdManager) get(port string) (pl *PortListener, ok bool) {
 	return
 }
 
-func (pm *PasswdManager) del(port string) {
+// del stops serving port and closes its connections, returning how many
+// there were. Their traffic is still saved once.
+func (pm *PasswdManager) del(port string) int {
 	pl, ok := pm.get(port)
 	if !ok {
-		return
+		return 0
 	}
-	pl.listener.Close()
+	pl.close()
 	pm.Lock()
 	delete(pm.portListener, port)
 	pm.Unlock()
+	n := closePortConns(port)
+	ss.Stats.Remove(port)
+	return n
 }
 
-// Update port password would first close a port and restart listening on that
-// port. A different approach would be directly change the password used by
-// that port, but that requires **sharing** password between the port listener
-// and password manager.
-func (pm *PasswdManager) updatePortPasswd(port, password string, auth bool) {
+// updatePort applies new settings to a port. The listener is only reopened
+// if its own options changed, otherwise the settings are used for the
+// connections accepted from now on and the open ones are left alone.
+func (pm *PasswdManager) updatePort(port string, s *portSettings, key string) {
 	pl, ok := pm.get(port)
 	if !ok {
 		log.Printf("new port %s added\n", port)
-	} else {
-		if pl.password == password {
-			return
-		}
-		log.Printf("closing port %s to update password\n", port)
-		pl.listener.Close()
+		go run(port, s)
+		return
+	}
+	if pl.key != key {
+		log.Printf("reopening port %s as its listener options changed\n", port)
+		pl.close()
+		// run will add the new port listener to passwdManager.
+		go run(port, s)
+		return
+	}
+	if changed := s.diff(pl.current()); changed != "" {
+		log.Printf("port %s: %s updated for new connections\n", port, changed)
+		pl.set(s)
 	}
-	// run will add the new port listener to passwdManager.
-	// So there maybe concurrent access to passwdManager and we need lock to protect it.
-	go run(port, password, auth)
 }
 
 var passwdManager = PasswdManager{portListener: map[string]*PortListener{}}
 
 func updatePasswd() {
-	var cdb *sql.DB;
-	log.Println("updating password")
-	newconfig, err := ss.ParseConfig(configFile,cdb)
+	reloadConfig(false)
+}
+
+// reloading keeps /reload and the periodic sync from overlapping.
+var reloading sync.Mutex
+
+// reloadConfig rereads the config file and the users and applies the
+// differences. A periodic sync is quiet unless something changed, and
+// only reads the database.
+func reloadConfig(periodic bool) {
+	reloading.Lock()
+	defer reloading.Unlock()
+	if !periodic {
+		log.Println("updating password")
+	}
+	// Parsing sets the read timeout, make sure it ends up as configured.
+	defer func() { ss.SetTimeout(currentConfig().Timeout) }()
+	load := ss.ParseConfig
+	if periodic {
+		// Every node syncs, only startup and /reload update the database.
+		load = ss.SyncConfig
+	}
+	newconfig, err := load(configFile, db)
 	if err != nil {
 		log.Printf("error parsing config file %s to update password: %v\n", configFile, err)
 		return
 	}
-	oldconfig := config
-	config = newconfig
-
-	if err = unifyPortPassword(config); err != nil {
+	if err = applyDefaults(newconfig); err != nil {
+		log.Printf("error in config file %s, not reloading: %v\n", configFile, err)
 		return
 	}
-	for port, passwd := range config.PortPassword {
-		passwdManager.updatePortPasswd(port, passwd, config.Auth)
-		if oldconfig.PortPassword != nil {
-			delete(oldconfig.PortPassword, port)
+	dropExpired(newconfig, time.Now())
+	if err = unifyPortPassword(newconfig); err != nil {
+		return
+	}
+	settings := make(map[string]*portSettings)
+	for port := range newconfig.PortPassword {
+		s, err := newPortSettings(newconfig, port)
+		if err != nil {
+			// One user's bad method mustn't hold up everyone else.
+			log.Printf("%v, leaving the port as it is\n", err)
+			continue
 		}
+		settings[port] = s
+	}
+	oldconfig := currentConfig()
+	config := newconfig
+	setConfig(config)
+	setExpiry(config)
+
+	if err = loadOutboundPolicy(config); err != nil {
+		log.Printf("error reloading outbound policy, keeping the old one: %v\n", err)
 	}
-	// port password still left in the old config should be closed
-	for port, _ := range oldconfig.PortPassword {
-		log.Printf("closing port %s as it's deleted\n", port)
-		passwdManager.del(port)
+	if err = loadTransport(config); err != nil {
+		log.Printf("error reloading transport, keeping the old one: %v\n", err)
+	}
+	if err = checkProbe(config); err != nil {
+		log.Printf("error reloading config: %v, failed handshakes are drained\n", err)
+	}
+	if err = loadBans(config, false); err != nil {
+		log.Printf("error reloading ban settings, keeping the old ones: %v\n", err)
+	}
+	if changed := configDiff(config, oldconfig); changed != "" {
+		log.Printf("%s updated\n", changed)
+	}
+	if periodic {
+		addDetails(config, oldconfig)
+	}
+	key := listenKey(config)
+	for port, s := range settings {
+		passwdManager.updatePort(port, s, key)
+	}
+	// ports only in the old config should be closed
+	for port := range oldconfig.PortPassword {
+		if _, ok := config.PortPassword[port]; !ok {
+			if _, ok = passwdManager.get(port); !ok {
+				continue // expired already
+			}
+			n := passwdManager.del(port)
+			log.Printf("closed port %s and %d connections as it's deleted\n", port, n)
+		}
+	}
+	if !periodic {
+		log.Println("password updated")
 	}
-	log.Println("password updated")
 }
 
 
 
-func run(port, password string, auth bool) {
-	ss.AddStat(port)
-	ln, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		log.Printf("error listening port %v: %v\n", port, err)
-		os.Exit(1)
+func run(port string, settings *portSettings) {
+	if shuttingDown() {
+		return
+	}
+	ss.Stats.Add(port)
+	config := currentConfig()
+	addr := ":" + port
+	if config.Plugin != "" {
+		// The plugin takes the public port and forwards to us on loopback.
+		addr = "127.0.0.1:0"
+	}
+	ln := inheritedListener("tcp:" + port)
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			log.Printf("error listening port %v: %v\n", port, err)
+			os.Exit(1)
+		}
+	}
+	raw := ln
+	ln = ss.NewWireListener(ln, port)
+	var err error
+	var plugin *ss.Plugin
+	if config.Plugin != "" {
+		local := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		plugin, err = ss.StartPlugin(config.Plugin, config.PluginOpts, "0.0.0.0", port, "127.0.0.1", local)
+		if err != nil {
+			log.Printf("error starting plugin %s for port %v: %v\n", config.Plugin, port, err)
+			ln.Close()
+			return
+		}
+		log.Printf("plugin %s serving port %v via 127.0.0.1:%v\n", config.Plugin, port, local)
+	} else {
+		ln = wrapListener(ln)
+	}
+	pl := &PortListener{listener: ln, raw: raw, key: listenKey(config), plugin: plugin, settings: settings}
+	passwdManager.add(port, pl)
+	relayRaw := config.RelayMode == "raw"
+	if relayRaw {
+		go runRelayUDP(config, port)
 	}
-	passwdManager.add(port, password, ln)
-	var cipher *ss.Cipher
 	log.Printf("server listening port %v ...\n", port)
 	for {
 		conn, err := ln.Accept()
@@ -279,17 +537,18 @@ func run(port, password string, auth bool) {
 			debug.Printf("accept error: %v\n", err)
 			return
 		}
-		// Creating cipher upon first connection.
-		if cipher == nil {
-			log.Println("creating cipher for port:", port)
-			cipher, err = ss.NewCipher(config.Method, password)
-			if err != nil {
-				log.Printf("Error generating cipher for port: %s %v\n", port, err)
-				conn.Close()
-				continue
-			}
+		if banned(conn.RemoteAddr()) {
+			debug.Printf("refused banned client %s on port %s\n", conn.RemoteAddr(), port)
+			conn.Close()
+			continue
+		}
+		if relayRaw {
+			serve(conn, port, func() { handleRelayRaw(conn, port) })
+			continue
 		}
-		go handleConnection(ss.NewConn(conn, cipher.Copy(),port), auth)
+		s := pl.current()
+		c := ss.NewConn(wrapObfs(conn, port), s.cipher.Copy(), port)
+		serve(conn, port, func() { handleConnection(c, s.auth) })
 	}
 }
 
@@ -303,12 +562,37 @@ func unifyPortPassword(config *ss.Config) (err error) {
 }
 
 
+// command line options, which override the config file
+var flagConfig ss.Config
+
+const defaultTimeout = 300
+
 var configFile string
-var config *ss.Config
+
+// loaded holds the config in use. Reloads replace it as a whole, so code
+// that isn't handed a config takes one with currentConfig and keeps to it.
+var loaded struct {
+	sync.RWMutex
+	config *ss.Config
+}
+
+func currentConfig() *ss.Config {
+	loaded.RLock()
+	defer loaded.RUnlock()
+	return loaded.config
+}
+
+func setConfig(config *ss.Config) {
+	loaded.Lock()
+	loaded.config = config
+	loaded.Unlock()
+}
+var adminListener net.Listener
 
 func main() {
 	log.SetOutput(os.Stdout)
-	var cmdConfig ss.Config
+	loadInherited()
+	var config *ss.Config
 	var printVer,justinit bool
 	var core int
 	var cdb *sql.DB
@@ -318,14 +602,24 @@ func main() {
 	flag.BoolVar(&justinit, "init", false, "init database.")
 	flag.BoolVar(&printVer, "v", false, "show version and about")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
-	flag.IntVar(&cmdConfig.Timeout, "t", 300, "timeout in seconds, default 300")
-	flag.StringVar(&cmdConfig.Method, "m", "", "encryption, default:aes-128-cfb")
+	flag.IntVar(&flagConfig.Timeout, "t", 300, "timeout in seconds, default 300")
+	flag.StringVar(&flagConfig.Method, "m", "", "encryption, default:aes-128-cfb")
 	flag.IntVar(&core, "core", 0, "maximum number of CPU cores to use, default is determinied by Go runtime")
 	flag.BoolVar((*bool)(&debug), "d", false, " ")
 	flag.StringVar(&tu, "tau", "", "ta user")
 	flag.StringVar(&tp, "tap", "", "ta pass")
+	flag.StringVar(&exportQuery, "export-traffic", "", "write traffic history as csv and exit, e.g. \"user=1&from=2006-01-02&to=2006-01-09&group=day\"")
 	flag.Parse()
-	ss.InitStats()
+	// The timeout only overrides the config file if given.
+	timeoutSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "t" {
+			timeoutSet = true
+		}
+	})
+	if !timeoutSet {
+		flagConfig.Timeout = 0
+	}
 
 	if printVer {
 		ss.PrintVersion()
@@ -344,9 +638,9 @@ func main() {
 
 	ss.SetDebug(debug)
 
-	if strings.HasSuffix(cmdConfig.Method, "-auth") {
-		cmdConfig.Method = cmdConfig.Method[:len(cmdConfig.Method)-5]
-		cmdConfig.Auth = true
+	if strings.HasSuffix(flagConfig.Method, "-auth") {
+		flagConfig.Method = flagConfig.Method[:len(flagConfig.Method)-5]
+		flagConfig.Auth = true
 	}
 
 	config, err = ss.ParseConfig(configFile,cdb)
@@ -355,9 +649,9 @@ func main() {
 			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", configFile, err)
 			os.Exit(1)
 		}
-		config = &cmdConfig
+		config = &flagConfig
 	} else {
-		ss.UpdateConfig(config, &cmdConfig)
+		ss.UpdateConfig(config, &flagConfig)
 	}
 	db, err = sql.Open("mysql", config.DSN)
 	if err!=nil {
@@ -368,51 +662,81 @@ func main() {
 	if justinit {
 		os.Exit(initDatabase())
 	}
-	if config.Method == "" {
-		config.Method = "aes-128-cfb"
+	if exportQuery != "" {
+		os.Exit(exportTraffic(exportQuery))
 	}
-	if err = ss.CheckCipherMethod(config.Method); err != nil {
+	if err = applyDefaults(config); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	dropExpired(config, time.Now())
+	setExpiry(config)
 	if err = unifyPortPassword(config); err != nil {
 		os.Exit(1)
 	}
+	setConfig(config)
+	if err = loadOutboundPolicy(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = loadTransport(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = checkProbe(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = loadBans(config, true); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	if core > 0 {
 		runtime.GOMAXPROCS(core)
 	}
 	
-	for port, password := range config.PortPassword {
-		go run(port, password, config.Auth)
+	for port := range config.PortPassword {
+		s, err := newPortSettings(config, port)
+		if err != nil {
+			log.Printf("%v, not opening the port\n", err)
+			continue
+		}
+		go run(port, s)
 	}
 	
 	http.HandleFunc("/", statusPage)
 	http.HandleFunc("/reload",reload)
+	http.HandleFunc("/bans", banPage)
+	http.HandleFunc("/ban", banHandler)
+	http.HandleFunc("/unban", unbanHandler)
+	http.HandleFunc("/traffic", trafficHandler)
 	go saveStat()
+	go syncUsers()
+	go expireUsers()
+	go billingCycles()
 	go safeQuitListener()
-	http.ListenAndServe(":7777", nil)	
+	go upgradeListener()
+	if adminListener = inheritedListener("admin"); adminListener == nil {
+		if adminListener, err = net.Listen("tcp", ":7777"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	closeInherited(config)
+	notifyReady()
+	http.Serve(adminListener, nil)	
 }
 
 
 
-func safeQuitListener() {
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, os.Kill)
-    <-c
-    println("Got break signal, dumping...")
-    save2DB(2)
-	dbfile.Close()
-    println("Dump finished... Exiting.")
-    os.Exit(0)
-}
-
 func reload(w http.ResponseWriter, req *http.Request) {
 	updatePasswd()
 	io.WriteString(w, "OK")
 }
 func statusPage(w http.ResponseWriter, req *http.Request) {
 	str := fmt.Sprintf("ShadowSocks Server Stat:\n\nDB pool: %d\n\n",db.Stats().OpenConnections) 
-	for port,stat:=range ss.Stats  {
+	str += fmt.Sprintf("Outbound failures:%s\n\n",dialFailureStat())
+	for port,stat:=range ss.Stats.Snapshot()  {
 		str += fmt.Sprintf("Port: %s\t U: %v(%v) D: %v(%v) T: %v\n",port,readable(stat.U),readable(stat.U+stat.Ue),readable(stat.D),readable(stat.D+stat.De),time.Unix(stat.T,0).Format("2006-01-02 15:04:05"))	 
 	} 
 	io.WriteString(w, str)
@@ -444,6 +768,9 @@ func saveStat() {
     }
 }
 
+// saving2DB keeps the periodic and the final dump from interleaving.
+var saving2DB sync.Mutex
+
 func save2DB(r int) {
 	if r==2 {
 		fmt.Println("Stop signal received! Dumping stat to database!")
@@ -452,30 +779,37 @@ func save2DB(r int) {
 	sqlpu := "UPDATE ss_detail SET u = CASE user_id" //WHERE server_id = {{config.ServerID}} 
 	var whenpp1,whenpp2,whenpp3,whenpp4,whenpu1,whenpu2,whenpu3,whenpu4,inpp,inpu string
 	t := time.Now().Unix()
+	var hourly []string
 	i := 0
-	for port,stat:=range ss.Stats {
-		if stat.U==0 {
-			debug.Printf("[dump2db] port %s upstream data 0, skipped. U:%d D:%d Ue:%d De:%d",port,stat.U,stat.D,stat.Ue,stat.De)
-			continue
-		}
+	config := currentConfig()
+	saving2DB.Lock()
+	defer saving2DB.Unlock()
+	for port,stat:=range ss.Stats.Flush() {
 		i++
-		u := stat.U;	d := stat.D;	ue := stat.Ue;	de := stat.De;	
-		stat.U -= u;	stat.D -= d;	stat.Ue -= ue;	stat.De -= de;
+		u := stat.U;	d := stat.D;	ue := stat.Ue;	de := stat.De;
 		whenpp1 += fmt.Sprintf(" WHEN %v THEN u+%v",port,u)
 		whenpp2 += fmt.Sprintf(" WHEN %v THEN d+%v",port,d)
 		whenpp3 += fmt.Sprintf(" WHEN %v THEN ue+%v",port,ue)
 		whenpp4 += fmt.Sprintf(" WHEN %v THEN de+%v",port,de)
-		
-		whenpu1 += fmt.Sprintf(" WHEN %v THEN u+%v",config.PortUID[port],u)
-		whenpu2 += fmt.Sprintf(" WHEN %v THEN d+%v",config.PortUID[port],d)
-		whenpu3 += fmt.Sprintf(" WHEN %v THEN ue+%v",config.PortUID[port],ue)
-		whenpu4 += fmt.Sprintf(" WHEN %v THEN de+%v",config.PortUID[port],de)
 		if inpp=="" {
 			inpp = port
-			inpu = config.PortUID[port]
 		} else {
 			inpp += fmt.Sprintf(",%s",port)
-			inpu += fmt.Sprintf(",%s",config.PortUID[port])
+		}
+		uid, ok := config.PortUID[port]
+		if !ok {
+			// removed since, the ss_user row is all there's left to update
+			continue
+		}
+		whenpu1 += fmt.Sprintf(" WHEN %v THEN u+%v",uid,u)
+		whenpu2 += fmt.Sprintf(" WHEN %v THEN d+%v",uid,d)
+		whenpu3 += fmt.Sprintf(" WHEN %v THEN ue+%v",uid,ue)
+		whenpu4 += fmt.Sprintf(" WHEN %v THEN de+%v",uid,de)
+		hourly = append(hourly, fmt.Sprintf("(%v,%v,%v,%v,%v,%v,%v)",config.ServerID,uid,t-t%3600,u,d,ue,de))
+		if inpu=="" {
+			inpu = uid
+		} else {
+			inpu += fmt.Sprintf(",%s",uid)
 		}
 	}
 	if i==0 {
@@ -494,11 +828,21 @@ func save2DB(r int) {
 		debug.Printf("[DBEXEC ERROR] %s",err.Error())
 		dbFail(sqlpp,err)
 	}
+	if inpu=="" {
+		return
+	}
 	_,err = db.Exec(sqlpu)
 	if (err!=nil) {
 		debug.Printf("[DBEXEC ERROR] %s",err.Error())
 		dbFail(sqlpu,err)
 	}
+	sqlth := trafficHistorySQL(hourly)
+	debug.Println("SQL-th:",sqlth)
+	_,err = db.Exec(sqlth)
+	if (err!=nil) {
+		debug.Printf("[DBEXEC ERROR] %s",err.Error())
+		dbFail(sqlth,err)
+	}
 }
 
 func dbFail(sql string,err error) {
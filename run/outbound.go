@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// outboundPolicy decides where users' connections may go. It is rebuilt from
+// the config on start and on every reload.
+type outboundPolicy struct {
+	block    *ss.IPBlocklist
+	rules    *ss.RuleSet            // nil if no acl is configured
+	named    map[string]*ss.RuleSet // policies users can be assigned to
+	userPort map[string]string      // port to policy name, for users that have one
+	ups      ss.Upstreams
+	upstream string        // default route
+	relay    ss.ConnDialer // backend of a reencrypting relay node, replaces the default route
+	bind     *ss.BindPool
+	userBind map[string]*ss.BindPool // port to dedicated egress addresses
+	resolver *ss.Resolver
+	dns      ss.ResolverConfig
+	// deadline for resolving and connecting to a target
+	connectTimeout time.Duration
+}
+
+var outbound struct {
+	sync.RWMutex
+	policy *outboundPolicy
+}
+
+// policyError is returned by dialOutbound when policy forbids the target.
+type policyError struct {
+	policy string
+}
+
+func (e *policyError) Error() string {
+	return "destination denied by policy " + e.policy
+}
+
+const defaultConnectTimeout = 10 * time.Second
+
+func loadOutboundPolicy(config *ss.Config) error {
+	cidrs := config.OutboundBlock
+	if cidrs == nil {
+		cidrs = ss.DefaultBlockedCIDRs
+	}
+	block, err := ss.NewIPBlocklist(cidrs)
+	if err != nil {
+		return fmt.Errorf("outbound_block: %v", err)
+	}
+	var rules *ss.RuleSet
+	if config.ACL != "" {
+		if rules, err = ss.LoadRuleSet(config.ACL); err != nil {
+			return fmt.Errorf("acl: %v", err)
+		}
+	}
+	named := make(map[string]*ss.RuleSet, len(config.Policies))
+	for name, path := range config.Policies {
+		if named[name], err = ss.LoadRuleSet(path); err != nil {
+			return fmt.Errorf("policy %s: %v", name, err)
+		}
+	}
+	connectTimeout := time.Duration(config.ConnectTimeout) * time.Second
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	ups, err := ss.NewUpstreams(config.Upstreams, &net.Dialer{Timeout: connectTimeout})
+	if err != nil {
+		return err
+	}
+	if _, err = ups.Get(config.Upstream); err != nil {
+		return fmt.Errorf("upstream: %v", err)
+	}
+	for name, rs := range named {
+		for _, route := range rs.RouteNames() {
+			if _, err = ups.Get(route); err != nil {
+				return fmt.Errorf("policy %s: %v", name, err)
+			}
+		}
+	}
+	for _, route := range rules.RouteNames() {
+		if _, err = ups.Get(route); err != nil {
+			return fmt.Errorf("acl: %v", err)
+		}
+	}
+	relay, err := newRelayDialer(config)
+	if err != nil {
+		return fmt.Errorf("relay: %v", err)
+	}
+	bind, err := ss.NewBindPool(config.OutboundBind)
+	if err != nil {
+		return fmt.Errorf("outbound_bind: %v", err)
+	}
+	userBind := make(map[string]*ss.BindPool, len(config.PortEgress))
+	for port, addrs := range config.PortEgress {
+		if userBind[port], err = ss.NewBindPool([]string{addrs}); err != nil {
+			// Don't fail the whole reload for one bad row, but don't let
+			// the user out through the shared addresses either.
+			log.Printf("ERROR port %s egress_ip: %v, its connections will fail\n", port, err)
+			userBind[port] = &ss.BindPool{}
+		}
+	}
+	dns := ss.ResolverConfig{
+		Upstreams: config.DNS,
+		Prefer:    config.DNSPrefer,
+		Hosts:     config.DNSHosts,
+		Timeout:   time.Duration(config.DNSTimeout) * time.Second,
+	}
+	var resolver *ss.Resolver
+	if old := currentOutboundPolicy(); old != nil && reflect.DeepEqual(old.dns, dns) {
+		// Keep the cache warm across reloads.
+		resolver = old.resolver
+	} else if resolver, err = ss.NewResolver(dns); err != nil {
+		return err
+	}
+	userPort := make(map[string]string, len(config.PortPolicy))
+	for port, name := range config.PortPolicy {
+		if _, ok := named[name]; !ok {
+			// Users with an unknown policy are denied everything, so a typo
+			// in ss_user can't give a restricted user full access.
+			log.Printf("port %s uses undefined policy %q, all destinations will be denied\n", port, name)
+		}
+		userPort[port] = name
+	}
+	outbound.Lock()
+	outbound.policy = &outboundPolicy{block: block, rules: rules, named: named, userPort: userPort,
+		ups: ups, upstream: config.Upstream, relay: relay, bind: bind, userBind: userBind,
+		resolver: resolver, dns: dns, connectTimeout: connectTimeout}
+	outbound.Unlock()
+	log.Printf("outbound policy loaded, %d blocked ranges, acl %q, %d named policies, %d upstreams\n",
+		len(cidrs), config.ACL, len(named), len(ups))
+	return nil
+}
+
+func currentOutboundPolicy() *outboundPolicy {
+	outbound.RLock()
+	defer outbound.RUnlock()
+	return outbound.policy
+}
+
+// ruleSet returns the rules for the user listening on port and the name of
+// the policy they come from ("global" for the acl in the config file).
+func (p *outboundPolicy) ruleSet(port string) (rules *ss.RuleSet, name string, ok bool) {
+	name, ok = p.userPort[port]
+	if !ok {
+		return p.rules, "global", true
+	}
+	rules, ok = p.named[name]
+	return
+}
+
+// denied returns the name of the policy denying t to a user with rules, ""
+// if it's allowed. The outbound_block_list of the global acl applies to
+// everyone, a named policy is checked on top of it.
+func (p *outboundPolicy) denied(rules *ss.RuleSet, name string, t ss.Target) string {
+	if p.rules.Blocked(t) {
+		return "global"
+	}
+	if !rules.Allowed(t) {
+		return name
+	}
+	return ""
+}
+
+// upstreamFor returns the upstream proxy t should be reached through, nil
+// to connect directly.
+func (p *outboundPolicy) upstreamFor(rules *ss.RuleSet, t ss.Target) ss.ConnDialer {
+	name, ok := rules.Route(t)
+	if !ok {
+		if p.relay != nil {
+			return p.relay
+		}
+		name = p.upstream
+	}
+	up, _ := p.ups.Get(name) // names are checked when the policy is loaded
+	return up
+}
+
+// localAddr picks the address a direct connection from the user listening
+// on port to ip is made from: the user's own egress address if they have
+// any, otherwise one from the shared pool. nil lets the kernel choose. A
+// user with egress addresses but none of ip's family can't reach ip, they
+// never leave through shared ones.
+func (p *outboundPolicy) localAddr(port string, ip net.IP) (net.Addr, error) {
+	var local net.IP
+	if own, ok := p.userBind[port]; ok {
+		if local = own.Pick(ip); local == nil {
+			return nil, fmt.Errorf("port %s has no egress address for %s", port, ip)
+		}
+	} else if local = p.bind.Pick(ip); local == nil {
+		return nil, nil
+	}
+	return &net.TCPAddr{IP: local}, nil
+}
+
+// dialOutbound connects to host (in host:port form) on behalf of the user
+// listening on port. The host is resolved here and the resulting addresses
+// are checked and dialed directly, so a name can't pass the check with a
+// public address and then be re-resolved to a blocked one (DNS rebinding).
+// When a name has addresses of both families they are raced as in rfc8305.
+func dialOutbound(host, port string) (net.Conn, error) {
+	target, err := ss.NewTarget(host, nil)
+	if err != nil {
+		return nil, err
+	}
+	policy := currentOutboundPolicy()
+	rules, name, ok := policy.ruleSet(port)
+	if !ok {
+		return nil, &policyError{name}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policy.connectTimeout)
+	defer cancel()
+	var ips []net.IP
+	if target.IP != nil {
+		ips = []net.IP{target.IP}
+	} else if up := policy.upstreamFor(rules, target); up != nil {
+		// Domains routed through an upstream are resolved there, on the
+		// upstream's network, so only the domain and port rules apply.
+		if by := policy.denied(rules, name, target); by != "" {
+			return nil, &policyError{by}
+		}
+		return up.DialContext(ctx, "tcp", host)
+	} else if ips, err = policy.resolver.LookupIP(ctx, target.Domain); err != nil {
+		return nil, &ss.DialError{Class: ss.FailDNS, Err: err}
+	}
+	var allowed []net.IP
+	var denied error
+	for _, ip := range ips {
+		target.IP = ip
+		if policy.block.Contains(ip) {
+			debug.Printf("outbound: %s (%s) is in outbound_block\n", host, ip)
+			denied = &policyError{"outbound_block"}
+			continue
+		}
+		if by := policy.denied(rules, name, target); by != "" {
+			debug.Printf("outbound: %s (%s) denied by policy %s\n", host, ip, by)
+			denied = &policyError{by}
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		if denied == nil {
+			denied = &ss.DialError{Class: ss.FailDNS, Err: ss.ErrNoSuchHost}
+		}
+		return nil, denied
+	}
+	dstPort := strconv.Itoa(target.Port)
+	return ss.DialParallel(ctx, allowed, ss.DefaultAttemptDelay, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		addr := net.JoinHostPort(ip.String(), dstPort)
+		t := target
+		t.IP = ip
+		if up := policy.upstreamFor(rules, t); up != nil {
+			return up.DialContext(ctx, "tcp", addr)
+		}
+		local, err := policy.localAddr(port, ip)
+		if err != nil {
+			return nil, err
+		}
+		d := net.Dialer{LocalAddr: local}
+		return d.DialContext(ctx, "tcp", addr)
+	})
+}
+
+// dialFailures counts failed outbound connections by ss.ClassifyDialError
+// class, plus "denied" for policy rejections.
+var dialFailures = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: map[string]int64{}}
+
+func countDialFailure(class string) {
+	dialFailures.Lock()
+	dialFailures.counts[class]++
+	dialFailures.Unlock()
+}
+
+func dialFailureStat() string {
+	dialFailures.Lock()
+	defer dialFailures.Unlock()
+	str := ""
+	for _, class := range []string{"denied", ss.FailDNS, ss.FailTimeout, ss.FailRefused, ss.FailUnreachable, ss.FailOther} {
+		str += fmt.Sprintf(" %s: %d", class, dialFailures.counts[class])
+	}
+	return str
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+func TestOutboundDenied(t *testing.T) {
+	global, err := ss.ParseRuleSet(strings.NewReader("[black_list]\ndomain:blocked.example.com\n[outbound_block_list]\nport:25\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := ss.ParseRuleSet(strings.NewReader("[accept_all]\n[white_list]\nport:25\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &outboundPolicy{rules: global, named: map[string]*ss.RuleSet{"open": open}}
+	for _, c := range []struct {
+		host  string
+		rules *ss.RuleSet
+		name  string
+		by    string
+	}{
+		{"mail.example.com:25", global, "global", "global"},
+		{"mail.example.com:25", open, "open", "global"},
+		{"blocked.example.com:443", global, "global", "global"},
+		{"blocked.example.com:443", open, "open", ""},
+		{"example.com:443", open, "open", ""},
+	} {
+		target, err := ss.NewTarget(c.host, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if by := p.denied(c.rules, c.name, target); by != c.by {
+			t.Errorf("%s with policy %s: denied by %q, want %q", c.host, c.name, by, c.by)
+		}
+	}
+}
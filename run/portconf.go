@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// portSettings is what new connections to a port are served with. Reload
+// swaps it without touching the listener or open connections.
+type portSettings struct {
+	password string
+	method   string
+	auth     bool
+	cipher   *ss.Cipher // copied for every connection
+	// read from the config by every connection, only kept to log changes
+	policy, egress, obfs string
+	expire               int64
+}
+
+// newPortSettings builds the settings of port, with the user's own cipher
+// method if it has one, so users can be moved to another method one by one.
+func newPortSettings(config *ss.Config, port string) (*portSettings, error) {
+	s := &portSettings{
+		password: config.PortPassword[port],
+		method:   config.Method,
+		auth:     config.Auth,
+		policy:   config.PortPolicy[port],
+		egress:   config.PortEgress[port],
+		obfs:     config.PortObfs[port],
+		expire:   config.PortExpire[port],
+	}
+	if m := config.PortMethod[port]; m != "" {
+		// One time auth is part of the user's method, not the global one.
+		s.method = strings.ToLower(m)
+		s.auth = strings.HasSuffix(s.method, "-auth")
+		if s.auth {
+			s.method = s.method[:len(s.method)-5]
+		}
+	}
+	if err := ss.CheckCipherMethod(s.method); err != nil {
+		return nil, fmt.Errorf("port %s: %v", port, err)
+	}
+	var err error
+	if s.cipher, err = ss.NewCipher(s.method, s.password); err != nil {
+		return nil, fmt.Errorf("port %s: %v", port, err)
+	}
+	return s, nil
+}
+
+// diff names the settings that differ from old.
+func (s *portSettings) diff(old *portSettings) string {
+	var changed []string
+	if s.password != old.password {
+		changed = append(changed, "password")
+	}
+	if s.method != old.method {
+		changed = append(changed, "method")
+	}
+	if s.auth != old.auth {
+		changed = append(changed, "auth")
+	}
+	if s.policy != old.policy {
+		changed = append(changed, "policy")
+	}
+	if s.egress != old.egress {
+		changed = append(changed, "egress_ip")
+	}
+	if s.obfs != old.obfs {
+		changed = append(changed, "obfs")
+	}
+	if s.expire != old.expire {
+		changed = append(changed, "expire")
+	}
+	return strings.Join(changed, ", ")
+}
+
+// configDiff names the options applying to every port that differ from
+// old.
+func configDiff(config, old *ss.Config) string {
+	var changed []string
+	for _, o := range []struct {
+		name     string
+		new, old interface{}
+	}{
+		{"timeout", config.Timeout, old.Timeout},
+		{"connect_timeout", config.ConnectTimeout, old.ConnectTimeout},
+		{"outbound_block", config.OutboundBlock, old.OutboundBlock},
+		{"acl", config.ACL, old.ACL},
+		{"policies", config.Policies, old.Policies},
+		{"upstreams", config.Upstreams, old.Upstreams},
+		{"upstream", config.Upstream, old.Upstream},
+	} {
+		if !reflect.DeepEqual(o.new, o.old) {
+			changed = append(changed, o.name)
+		}
+	}
+	return strings.Join(changed, ", ")
+}
+
+// listenKey sums up the options a port's listener is built from. A port is
+// only reopened when it changes.
+func listenKey(config *ss.Config) string {
+	return strings.Join([]string{
+		config.Plugin, config.PluginOpts,
+		config.Transport, config.WSPath, config.TLSCert, config.TLSKey, config.Decoy,
+		config.RelayMode,
+	}, "\x00")
+}
+
+// applyDefaults applies the command line options and the defaults to a
+// freshly parsed config, and checks the cipher method.
+func applyDefaults(config *ss.Config) error {
+	ss.UpdateConfig(config, &flagConfig)
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+		ss.SetTimeout(config.Timeout)
+	}
+	if config.Method == "" {
+		config.Method = "aes-128-cfb"
+	}
+	return ss.CheckCipherMethod(config.Method)
+}
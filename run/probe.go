@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// What happens to a connection whose request can't be read or verified.
+// Closing it right away tells active probers they found a shadowsocks
+// server, so by default it is drained like a server waiting for more of a
+// request would.
+const (
+	probeDrain = "drain"
+	probeClose = "close"
+)
+
+// A failed connection is read from for a random time and amount in these
+// ranges, whichever ends first.
+const (
+	probeMinTime  = 10 * time.Second
+	probeMaxTime  = 60 * time.Second
+	probeMinBytes = 4 * 1024
+	probeMaxBytes = 256 * 1024
+)
+
+func checkProbe(config *ss.Config) error {
+	modes := map[string]string{"": config.Probe}
+	for port, mode := range config.PortProbe {
+		modes[port] = mode
+	}
+	for port, mode := range modes {
+		switch mode {
+		case "", probeDrain, probeClose:
+		default:
+			if port == "" {
+				return fmt.Errorf("probe: unknown mode %q", mode)
+			}
+			return fmt.Errorf("port_probe %s: unknown mode %q", port, mode)
+		}
+	}
+	return nil
+}
+
+func probeMode(port string) string {
+	config := currentConfig()
+	if mode, ok := config.PortProbe[port]; ok {
+		return mode
+	}
+	return config.Probe
+}
+
+// rejectProbe gets rid of a connection that failed the handshake on port.
+// The caller closes conn afterwards. Whatever check failed, the client
+// sees the same thing: its data swallowed and, eventually, a close.
+func rejectProbe(conn net.Conn, port string) {
+	if probeMode(port) == probeClose {
+		return
+	}
+	// Framings like obfs fail on every read after a bad handshake, drain
+	// what's under them.
+	for {
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+	d := probeMinTime + time.Duration(rand.Int63n(int64(probeMaxTime-probeMinTime)))
+	n := probeMinBytes + rand.Int63n(probeMaxBytes-probeMinBytes)
+	conn.SetReadDeadline(time.Now().Add(d))
+	io.Copy(io.Discard, io.LimitReader(conn, n))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// A relay node sits between users and an exit node. In raw mode it forwards
+// the still encrypted streams and datagrams of each port to the same port (or
+// the fixed port in relay_addr) on the backend, so the backend must know the
+// same users. In reencrypt mode connections are decrypted with the user's
+// password as usual and sent on to the backend with the node's own relay
+// cipher, see loadOutboundPolicy.
+
+// relayBackend returns the backend address for a user port.
+func relayBackend(config *ss.Config, port string) string {
+	if _, _, err := net.SplitHostPort(config.RelayAddr); err == nil {
+		return config.RelayAddr
+	}
+	return net.JoinHostPort(config.RelayAddr, port)
+}
+
+// newRelayDialer returns the dialer reencrypting connections are sent
+// through, or nil if this node doesn't reencrypt.
+func newRelayDialer(config *ss.Config) (ss.ConnDialer, error) {
+	if config.RelayMode != "reencrypt" {
+		return nil, nil
+	}
+	cipher, err := ss.NewCipher(config.RelayMethod, config.RelayPassword)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ss.NewDialer(config.RelayAddr, cipher)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func handleRelayRaw(conn net.Conn, port string) {
+	backend := relayBackend(currentConfig(), port)
+	if debug {
+		debug.Printf("relay %s->%s to %s\n", conn.RemoteAddr(), conn.LocalAddr(), backend)
+	}
+	remote, err := net.DialTimeout("tcp", backend, currentOutboundPolicy().connectTimeout)
+	if err != nil {
+		log.Println("error connecting to relay backend:", backend, err)
+		conn.Close()
+		return
+	}
+	go ss.PipeThenCloseStat(conn, remote, port, true)
+	ss.PipeThenCloseStat(remote, conn, port, false)
+}
+
+// runRelayUDP forwards the udp datagrams sent to port to the backend, with
+// one backend socket per client address.
+func runRelayUDP(config *ss.Config, port string) {
+	pc := inheritedPacketConn("udp:" + port)
+	if pc == nil {
+		var err error
+		if pc, err = net.ListenPacket("udp", ":"+port); err != nil {
+			log.Printf("error listening udp port %v: %v\n", port, err)
+			return
+		}
+	}
+	passwdManager.addUDP(port, pc)
+	backend, err := net.ResolveUDPAddr("udp", relayBackend(config, port))
+	if err != nil {
+		log.Printf("error resolving relay backend for port %v: %v\n", port, err)
+		pc.Close()
+		return
+	}
+	log.Printf("relay listening udp port %v ...\n", port)
+	var mu sync.Mutex
+	nat := map[string]*net.UDPConn{}
+	buf := make([]byte, 64*1024)
+	for {
+		n, caddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			// closed to update or delete the port
+			debug.Printf("udp read error: %v\n", err)
+			mu.Lock()
+			for _, rc := range nat {
+				rc.Close()
+			}
+			mu.Unlock()
+			return
+		}
+		key := caddr.String()
+		mu.Lock()
+		rc, ok := nat[key]
+		if !ok {
+			if rc, err = net.DialUDP("udp", nil, backend); err != nil {
+				mu.Unlock()
+				log.Println("error connecting to relay backend:", backend, err)
+				continue
+			}
+			nat[key] = rc
+			timeout := time.Duration(currentConfig().Timeout) * time.Second
+			go func() {
+				relayUDPReplies(pc, rc, caddr, port, timeout)
+				mu.Lock()
+				delete(nat, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		ss.AddPacketWire(port, caddr, n, true)
+		ss.AddTraffic(port, n, 0)
+		if _, err = rc.Write(buf[:n]); err != nil {
+			debug.Printf("udp write error: %v\n", err)
+		}
+	}
+}
+
+// relayUDPReplies sends the backend's replies to caddr until it has been
+// quiet for timeout, unless zero.
+func relayUDPReplies(pc net.PacketConn, rc *net.UDPConn, caddr net.Addr, port string, timeout time.Duration) {
+	defer rc.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		if timeout > 0 {
+			rc.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, err := rc.Read(buf)
+		if err != nil {
+			return
+		}
+		ss.AddPacketWire(port, caddr, n, false)
+		ss.AddTraffic(port, 0, n)
+		if _, err = pc.WriteTo(buf[:n], caddr); err != nil {
+			return
+		}
+	}
+}
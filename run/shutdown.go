@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// active tracks client connections, so shutdown can wait for them.
+var active struct {
+	sync.Mutex
+	closing bool
+	conns   map[net.Conn]string // to the port they came in on
+	wg      sync.WaitGroup
+}
+
+// trackConn registers a client connection to port, unless the server is
+// shutting down, in which case false is returned and conn must be closed.
+func trackConn(conn net.Conn, port string) bool {
+	active.Lock()
+	defer active.Unlock()
+	if active.closing {
+		return false
+	}
+	if active.conns == nil {
+		active.conns = make(map[net.Conn]string)
+	}
+	active.conns[conn] = port
+	active.wg.Add(1)
+	return true
+}
+
+func untrackConn(conn net.Conn) {
+	active.Lock()
+	delete(active.conns, conn)
+	active.Unlock()
+	active.wg.Done()
+}
+
+// closePortConns closes the client connections of port and returns how
+// many there were.
+func closePortConns(port string) int {
+	active.Lock()
+	defer active.Unlock()
+	n := 0
+	for conn, p := range active.conns {
+		if p == port {
+			conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+func shuttingDown() bool {
+	active.Lock()
+	defer active.Unlock()
+	return active.closing
+}
+
+// serve runs handle for a client connection of port as long as the server
+// isn't shutting down.
+func serve(conn net.Conn, port string, handle func()) {
+	if !trackConn(conn, port) {
+		conn.Close()
+		return
+	}
+	go func() {
+		defer untrackConn(conn)
+		handle()
+	}()
+}
+
+// waitConns waits up to timeout for the tracked connections to finish and
+// tells whether they did.
+func waitConns(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		active.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown stops accepting connections, lets the open ones finish for up to
+// the configured time, then closes the rest and saves the final stats.
+func shutdown() {
+	active.Lock()
+	active.closing = true
+	n := len(active.conns)
+	active.Unlock()
+	passwdManager.closeAll()
+
+	timeout := defaultShutdownTimeout
+	if t := currentConfig().ShutdownTimeout; t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	log.Printf("stopped listening, waiting up to %v for %d connections\n", timeout, n)
+	if !waitConns(timeout) {
+		active.Lock()
+		log.Printf("closing %d remaining connections\n", len(active.conns))
+		for conn := range active.conns {
+			conn.Close()
+		}
+		active.Unlock()
+		// Give the pipes a moment to count their last bytes.
+		waitConns(2 * time.Second)
+	}
+	log.Println("dumping stats to database")
+	save2DB(2)
+	saveBans()
+	db.Close()
+	dbfile.Close()
+	log.Println("dump finished, exiting")
+}
+
+func safeQuitListener() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	log.Printf("got %v, shutting down (again to exit at once)\n", sig)
+	go func() {
+		<-c
+		log.Println("exiting without waiting for connections")
+		save2DB(2)
+		os.Exit(1)
+	}()
+	shutdown()
+	os.Exit(0)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+const defaultSyncInterval = 60 * time.Second
+
+// syncUsers reloads the config, and with it the users from the database,
+// every sync_interval seconds. Each wait is randomized by up to a tenth of
+// the interval, and the first one by up to a whole interval, so nodes
+// started together don't query MySQL at the same moment.
+func syncUsers() {
+	interval := syncInterval()
+	if interval <= 0 {
+		log.Println("periodic user sync disabled")
+		return
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+	for {
+		reloadConfig(true)
+		if interval = syncInterval(); interval <= 0 {
+			log.Println("periodic user sync disabled")
+			return
+		}
+		jitter := time.Duration(rand.Int63n(int64(interval)/5+1)) - interval/10
+		time.Sleep(interval + jitter)
+	}
+}
+
+func syncInterval() time.Duration {
+	config := currentConfig()
+	switch {
+	case config.SyncInterval < 0:
+		return 0
+	case config.SyncInterval == 0:
+		return defaultSyncInterval
+	}
+	return time.Duration(config.SyncInterval) * time.Second
+}
+
+// addDetails adds the ss_detail rows traffic is saved to for the users a
+// periodic sync found that weren't in old. Full loads add them for all.
+func addDetails(config, old *ss.Config) {
+	var uids []string
+	for port, uid := range config.PortUID {
+		if _, ok := old.PortUID[port]; !ok {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+	_, err := db.Exec(fmt.Sprintf("INSERT IGNORE INTO ss_detail (server_id, user_id) SELECT %d, id FROM ss_user WHERE id IN (%s)",
+		config.ServerID, strings.Join(uids, ",")))
+	if err != nil {
+		log.Printf("error adding ss_detail rows of new users: %v\n", err)
+	}
+}
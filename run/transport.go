@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	ss "github.com/realpg/ssgo/shadowsocks"
+)
+
+// transport wraps the listeners of newly opened ports, and connections in
+// simple-obfs framing. It is loaded on start and on reload, ports already
+// listening keep their listener but pick up obfs changes.
+type transport struct {
+	ws       *ss.WSConfig // nil for plain tcp
+	decoy    http.Handler
+	obfs     string
+	portObfs map[string]string
+}
+
+var listenTransport struct {
+	sync.RWMutex
+	t *transport
+}
+
+func loadTransport(config *ss.Config) error {
+	t := &transport{}
+	switch config.Transport {
+	case "", "tcp":
+	case "ws":
+		if config.Plugin != "" {
+			return errors.New("transport ws can't be combined with a plugin")
+		}
+		t.ws = &ss.WSConfig{Path: config.WSPath}
+		if config.TLSCert != "" || config.TLSKey != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			if err != nil {
+				return fmt.Errorf("tls_cert: %v", err)
+			}
+			t.ws.TLS = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"http/1.1"},
+			}
+		}
+		if config.Decoy != "" {
+			d, err := decoyHandler(config.Decoy)
+			if err != nil {
+				return fmt.Errorf("decoy: %v", err)
+			}
+			t.decoy = d
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", config.Transport)
+	}
+	if err := ss.CheckObfsMode(config.Obfs); err != nil {
+		return err
+	}
+	t.obfs = config.Obfs
+	t.portObfs = make(map[string]string)
+	for port, mode := range config.PortObfs {
+		if err := ss.CheckObfsMode(mode); err != nil {
+			log.Printf("port %s: %v, using the default\n", port, err)
+			continue
+		}
+		t.portObfs[port] = mode
+	}
+	listenTransport.Lock()
+	listenTransport.t = t
+	listenTransport.Unlock()
+	return nil
+}
+
+// decoyHandler serves what a visitor of the site, or a prober, sees: a
+// website behind a reverse proxy, or static files.
+func decoyHandler(decoy string) (http.Handler, error) {
+	if strings.HasPrefix(decoy, "http://") || strings.HasPrefix(decoy, "https://") {
+		u, err := url.Parse(decoy)
+		if err != nil {
+			return nil, err
+		}
+		return httputil.NewSingleHostReverseProxy(u), nil
+	}
+	return http.FileServer(http.Dir(decoy)), nil
+}
+
+func currentTransport() *transport {
+	listenTransport.RLock()
+	defer listenTransport.RUnlock()
+	return listenTransport.t
+}
+
+// wrapObfs removes the simple-obfs framing configured for port, if any, from
+// a client connection.
+func wrapObfs(conn net.Conn, port string) net.Conn {
+	t := currentTransport()
+	if t == nil {
+		return conn
+	}
+	mode, ok := t.portObfs[port]
+	if !ok {
+		mode = t.obfs
+	}
+	return ss.NewObfsServerConn(conn, mode)
+}
+
+// wrapListener applies the current transport to a port's listener.
+func wrapListener(ln net.Listener) net.Listener {
+	t := currentTransport()
+	if t == nil || t.ws == nil {
+		return ln
+	}
+	return ss.ListenWS(ln, t.ws, t.decoy)
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how long a new process gets to start serving before the upgrade is
+// abandoned
+const upgradeTimeout = 30 * time.Second
+
+// upgradeListener upgrades to the binary on disk on SIGUSR2: a child is
+// started with our listening sockets, and once it serves we drain our
+// connections and exit like on SIGTERM. It is refused with a plugin, whose
+// processes own the public ports and can't be handed over.
+func upgradeListener() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	for range c {
+		log.Println("got SIGUSR2, starting the new binary")
+		if err := upgrade(); err != nil {
+			log.Printf("upgrade failed, still serving: %v\n", err)
+			continue
+		}
+		log.Println("new process is serving, shutting down")
+		shutdown()
+		os.Exit(0)
+	}
+}
+
+func upgrade() error {
+	if shuttingDown() {
+		return errors.New("already shutting down")
+	}
+	if currentConfig().Plugin != "" {
+		return errors.New("not supported with a plugin, restart instead")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	names, files, err := passwdManager.files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if adminListener != nil {
+		f, err := fileOf(adminListener)
+		if err != nil {
+			return fmt.Errorf("admin listener: %v", err)
+		}
+		names = append(names, "admin")
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)))
+	cmd.ExtraFiles = append(files, w)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	// The child writes a byte when it serves. EOF means it died first.
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err = r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process (pid %d) didn't start serving: %v", cmd.Process.Pid, err)
+	}
+	log.Printf("new process has pid %d\n", cmd.Process.Pid)
+	cmd.Process.Release()
+	return nil
+}
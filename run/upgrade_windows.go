@@ -0,0 +1,5 @@
+package main
+
+// upgradeListener does nothing, sockets can't be handed to a child process
+// on windows.
+func upgradeListener() {}
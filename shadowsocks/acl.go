@@ -0,0 +1,92 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultBlockedCIDRs is used when the config has no outbound_block. It
+// covers loopback, private, link-local (including cloud metadata at
+// 169.254.169.254), carrier-grade NAT, multicast and reserved ranges, and
+// the IPv6 ranges embedding IPv4 addresses, which could otherwise reach
+// those: IPv4-compatible, NAT64 and 6to4. IPv4-mapped addresses are
+// matched as IPv4.
+var DefaultBlockedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"::/96",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// IPBlocklist is a set of CIDR ranges outbound connections may not reach.
+// IPv4-mapped IPv6 addresses are matched against the IPv4 ranges.
+type IPBlocklist struct {
+	nets []*net.IPNet
+}
+
+// NewIPBlocklist parses cidrs, each either a CIDR range or a single address.
+func NewIPBlocklist(cidrs []string) (*IPBlocklist, error) {
+	b := &IPBlocklist{}
+	for _, s := range cidrs {
+		n, err := ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		b.nets = append(b.nets, n)
+	}
+	return b, nil
+}
+
+// ParseCIDR parses a CIDR range, treating a bare address as a single host.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address or cidr: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip address or cidr: %s", s)
+	}
+	return n, nil
+}
+
+// Contains reports whether ip falls in one of the blocked ranges. A nil
+// blocklist blocks nothing.
+func (b *IPBlocklist) Contains(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range b.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
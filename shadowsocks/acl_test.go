@@ -0,0 +1,75 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{" 192.0.2.1 ", "192.0.2.1/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+	} {
+		n, err := ParseCIDR(c.in)
+		if err != nil || n.String() != c.want {
+			t.Errorf("ParseCIDR(%q) = %v, %v, want %s", c.in, n, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "10.0.0.256", "10.0.0.0/33", "example.com"} {
+		if _, err := ParseCIDR(in); err == nil {
+			t.Errorf("ParseCIDR(%q) accepted", in)
+		}
+	}
+}
+
+func TestDefaultBlocklist(t *testing.T) {
+	b, err := NewIPBlocklist(DefaultBlockedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"224.0.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		// private IPv4 in IPv6 clothing
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::127.0.0.1", true},
+		{"::10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::169.254.169.254", true},
+		{"64:ff9b:1::a00:1", true},
+		{"2002:a00:1::1", true},
+		{"2002:7f00:1::", true},
+		// public
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	} {
+		if got := b.Contains(net.ParseIP(c.ip)); got != c.blocked {
+			t.Errorf("Contains(%s) = %v, want %v", c.ip, got, c.blocked)
+		}
+	}
+	var none *IPBlocklist
+	if none.Contains(net.ParseIP("127.0.0.1")) {
+		t.Error("nil blocklist blocks")
+	}
+}
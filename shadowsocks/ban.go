@@ -0,0 +1,292 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanConfig tells when a BanList bans a client: after MaxFailures failures
+// within Window, its network of IPv4Prefix or IPv6Prefix bits is banned for
+// BanTime. Loopback addresses and those in Trusted, like a proxy in front
+// of the server that every client appears to come from, are never banned.
+type BanConfig struct {
+	MaxFailures int
+	Window      time.Duration
+	BanTime     time.Duration
+	IPv4Prefix  int
+	IPv6Prefix  int
+	Trusted     []*net.IPNet
+}
+
+// DefaultBanConfig bans single IPv4 addresses and IPv6 /64s failing 10
+// times a minute for 10 minutes.
+var DefaultBanConfig = BanConfig{
+	MaxFailures: 10,
+	Window:      time.Minute,
+	BanTime:     10 * time.Minute,
+	IPv4Prefix:  32,
+	IPv6Prefix:  64,
+}
+
+// failures kept before stale entries are swept
+const banSweepLen = 10000
+
+// Ban is a banned network and when the ban ends.
+type Ban struct {
+	Net   string    `json:"net"`
+	Until time.Time `json:"until"`
+}
+
+// BanList counts failures of client addresses in a sliding window and bans
+// the networks of those exceeding the limit. It is safe for concurrent use.
+type BanList struct {
+	mu       sync.Mutex
+	cfg      BanConfig
+	failures map[string][]time.Time
+	bans     map[string]time.Time // cidr to expiry
+	// bans that aren't of the configured prefix lengths, checked one by one
+	custom map[string]*net.IPNet
+	now    func() time.Time
+}
+
+// NewBanList returns an empty ban list.
+func NewBanList(cfg BanConfig) *BanList {
+	return &BanList{
+		cfg:      cfg,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+		custom:   make(map[string]*net.IPNet),
+		now:      time.Now,
+	}
+}
+
+// Configure replaces the limits, keeping current bans and failures.
+func (b *BanList) Configure(cfg BanConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.IPv4Prefix != b.cfg.IPv4Prefix || cfg.IPv6Prefix != b.cfg.IPv6Prefix {
+		// Failures were counted per network of the old size.
+		b.failures = make(map[string][]time.Time)
+		for cidr := range b.bans {
+			if _, ok := b.custom[cidr]; !ok {
+				_, n, _ := net.ParseCIDR(cidr)
+				b.custom[cidr] = n
+			}
+		}
+	}
+	b.cfg = cfg
+}
+
+// key returns the network of ip that failures and bans are counted for.
+func (b *BanList) key(ip net.IP) string {
+	n := &net.IPNet{}
+	if ip4 := ip.To4(); ip4 != nil {
+		n.IP, n.Mask = ip4, net.CIDRMask(b.cfg.IPv4Prefix, 32)
+	} else {
+		n.IP, n.Mask = ip.To16(), net.CIDRMask(b.cfg.IPv6Prefix, 128)
+	}
+	n.IP = n.IP.Mask(n.Mask)
+	return n.String()
+}
+
+// trusted tells whether ip is never banned.
+func (b *BanList) trusted(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range b.cfg.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail records a failure of ip and tells whether that got it banned.
+func (b *BanList) Fail(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.MaxFailures <= 0 || ip == nil || b.trusted(ip) {
+		return false
+	}
+	now := b.now()
+	k := b.key(ip)
+	if until, ok := b.bans[k]; ok && now.Before(until) {
+		return false
+	}
+	times := append(recent(b.failures[k], now.Add(-b.cfg.Window)), now)
+	if len(times) < b.cfg.MaxFailures {
+		b.failures[k] = times
+		if len(b.failures) > banSweepLen {
+			b.sweep(now)
+		}
+		return false
+	}
+	delete(b.failures, k)
+	b.bans[k] = now.Add(b.cfg.BanTime)
+	return true
+}
+
+// recent drops the times before since.
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return times[i:]
+}
+
+func (b *BanList) sweep(now time.Time) {
+	since := now.Add(-b.cfg.Window)
+	for k, times := range b.failures {
+		if times = recent(times, since); len(times) == 0 {
+			delete(b.failures, k)
+		} else {
+			b.failures[k] = times
+		}
+	}
+	for k, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, k)
+			delete(b.custom, k)
+		}
+	}
+}
+
+// Banned tells whether ip is in a banned network.
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ip == nil || b.trusted(ip) {
+		return false
+	}
+	now := b.now()
+	k := b.key(ip)
+	if until, ok := b.bans[k]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(b.bans, k)
+		delete(b.custom, k)
+	}
+	for cidr, n := range b.custom {
+		if n.Contains(ip) && now.Before(b.bans[cidr]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban bans addr, an IP address (meaning its network of the configured
+// size) or a CIDR network, for d, or the configured ban time if d is zero.
+func (b *BanList) Ban(addr string, d time.Duration) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d == 0 {
+		d = b.cfg.BanTime
+	}
+	cidr, n, err := b.parse(addr)
+	if err != nil {
+		return "", err
+	}
+	b.bans[cidr] = b.now().Add(d)
+	if n != nil {
+		b.custom[cidr] = n
+	}
+	return cidr, nil
+}
+
+// parse returns the ban key of addr, and its network if that isn't of the
+// configured size.
+func (b *BanList) parse(addr string) (string, *net.IPNet, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return b.key(ip), nil, nil
+	}
+	ip, n, err := net.ParseCIDR(addr)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s is neither an ip address nor a network", addr)
+	}
+	if b.key(ip) == n.String() {
+		return n.String(), nil, nil
+	}
+	return n.String(), n, nil
+}
+
+// Unban lifts the ban of addr, given like to Ban, and tells whether there
+// was one.
+func (b *BanList) Unban(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cidr, _, err := b.parse(addr)
+	if err != nil {
+		return false
+	}
+	_, ok := b.bans[cidr]
+	delete(b.bans, cidr)
+	delete(b.custom, cidr)
+	delete(b.failures, cidr)
+	return ok
+}
+
+// List returns the current bans, the ones ending first first.
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.sweep(now)
+	list := make([]Ban, 0, len(b.bans))
+	for cidr, until := range b.bans {
+		list = append(list, Ban{cidr, until})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Until.Equal(list[j].Until) {
+			return list[i].Until.Before(list[j].Until)
+		}
+		return strings.Compare(list[i].Net, list[j].Net) < 0
+	})
+	return list
+}
+
+// Save writes the current bans to path as json.
+func (b *BanList) Save(path string) error {
+	data, err := json.MarshalIndent(b.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load restores bans saved to path that haven't ended yet. A missing file
+// is not an error.
+func (b *BanList) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Ban
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	now := b.now()
+	for _, ban := range list {
+		if d := ban.Until.Sub(now); d > 0 {
+			if _, err = b.Ban(ban.Net, d); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
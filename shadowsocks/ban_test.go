@@ -0,0 +1,85 @@
+package shadowsocks
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b := NewBanList(BanConfig{MaxFailures: 3, Window: time.Minute, BanTime: time.Hour, IPv4Prefix: 24, IPv6Prefix: 64})
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+
+	// Failures spread wider than the window don't add up.
+	b.Fail(net.ParseIP("192.0.2.1"))
+	now = now.Add(50 * time.Second)
+	b.Fail(net.ParseIP("192.0.2.2"))
+	now = now.Add(50 * time.Second)
+	if b.Fail(net.ParseIP("192.0.2.3")) {
+		t.Fatal("banned with failures outside the window")
+	}
+	if !b.Fail(net.ParseIP("192.0.2.4")) {
+		t.Fatal("not banned after 3 failures of the /24 within a minute")
+	}
+	if !b.Banned(net.ParseIP("192.0.2.200")) || b.Banned(net.ParseIP("192.0.3.1")) {
+		t.Error("ban doesn't cover exactly the /24")
+	}
+
+	if _, err := b.Ban("2001:db8::/32", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Banned(net.ParseIP("2001:db8:1:2::3")) {
+		t.Error("manual /32 ban not applied")
+	}
+	path := filepath.Join(t.TempDir(), "bans.json")
+	if err := b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.Unban("192.0.2.9") || b.Banned(net.ParseIP("192.0.2.4")) {
+		t.Error("unban by address in the network failed")
+	}
+	now = now.Add(2 * time.Hour)
+	if b.Banned(net.ParseIP("2001:db8::1")) {
+		t.Error("ban outlived its time")
+	}
+
+	restored := NewBanList(b.cfg)
+	restored.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	if err := restored.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.List()) != 2 || !restored.Banned(net.ParseIP("2001:db8::1")) {
+		t.Errorf("restored %v", restored.List())
+	}
+}
+
+func TestBanTrusted(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("198.51.100.0/24")
+	b := NewBanList(BanConfig{MaxFailures: 1, Window: time.Minute, BanTime: time.Hour, IPv4Prefix: 8, IPv6Prefix: 64,
+		Trusted: []*net.IPNet{proxy}})
+	for _, s := range []string{"127.0.0.1", "127.1.2.3", "::1", "198.51.100.7"} {
+		ip := net.ParseIP(s)
+		if b.Fail(ip) || b.Fail(ip) || b.Banned(ip) {
+			t.Errorf("%s banned for failures", s)
+		}
+	}
+	// Not even manual bans of a wider network apply.
+	if _, err := b.Ban("127.0.0.0/8", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Ban("198.0.0.0/8", 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.Banned(net.ParseIP("127.0.0.1")) || b.Banned(net.ParseIP("198.51.100.7")) {
+		t.Error("trusted address banned with its network")
+	}
+	if !b.Banned(net.ParseIP("198.51.101.7")) {
+		t.Error("untrusted address of the banned network not banned")
+	}
+	if !b.Fail(net.ParseIP("192.0.2.1")) {
+		t.Error("untrusted address not banned")
+	}
+}
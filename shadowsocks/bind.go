@@ -0,0 +1,56 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// BindPool is a set of local addresses outbound connections are made from.
+// Addresses are handed out round-robin among those of the target's family.
+type BindPool struct {
+	v4, v6 []net.IP
+	next   uint32
+}
+
+// NewBindPool parses addrs, each an IPv4 or IPv6 address. Entries may also
+// hold several comma separated addresses, as stored in ss_user.egress_ip.
+func NewBindPool(addrs []string) (*BindPool, error) {
+	p := &BindPool{}
+	for _, a := range addrs {
+		for _, s := range strings.Split(a, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid bind address %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				p.v4 = append(p.v4, ip4)
+			} else {
+				p.v6 = append(p.v6, ip)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Pick returns the local address to use for a connection to target, or nil
+// if the pool has no address of target's family.
+func (p *BindPool) Pick(target net.IP) net.IP {
+	if p == nil {
+		return nil
+	}
+	ips := p.v6
+	if target.To4() != nil {
+		ips = p.v4
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return ips[int(n-1)%len(ips)]
+}
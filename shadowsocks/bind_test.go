@@ -0,0 +1,41 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBindPool(t *testing.T) {
+	p, err := NewBindPool([]string{"192.0.2.1, 192.0.2.2", "2001:db8::1", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, v6 := net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8:1::1")
+	// round-robin within the family
+	for _, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		if got := p.Pick(v4); got.String() != want {
+			t.Errorf("picked %v for ipv4, want %s", got, want)
+		}
+	}
+	if got := p.Pick(v6); got.String() != "2001:db8::1" {
+		t.Errorf("picked %v for ipv6", got)
+	}
+	// mapped addresses are ipv4
+	if got := p.Pick(net.ParseIP("::ffff:198.51.100.1")); got.To4() == nil {
+		t.Errorf("picked %v for mapped ipv4", got)
+	}
+
+	only4, _ := NewBindPool([]string{"192.0.2.1"})
+	if got := only4.Pick(v6); got != nil {
+		t.Errorf("picked %v of the wrong family", got)
+	}
+	var none *BindPool
+	if got := none.Pick(v4); got != nil {
+		t.Errorf("nil pool picked %v", got)
+	}
+	for _, bad := range []string{"192.0.2.300", "example.com", "192.0.2.1,nope"} {
+		if _, err = NewBindPool([]string{bad}); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
+	"net"
 	"net/http"
 	"math/rand"
 )
@@ -21,7 +23,72 @@ type Config struct {
 	// following options are only used by server
 	PortPassword map[string]string `json:"port_password"`
 	PortUID map[string]string
+	PortPolicy map[string]string // port to policy name, loaded from ss_user.policy
+	PortEgress map[string]string // port to dedicated egress addresses, from ss_user.egress_ip
+	PortObfs map[string]string // port to simple-obfs mode, from ss_user.obfs
+	PortMethod map[string]string // port to cipher method, from ss_user.method, Method if unset
+	PortExpire map[string]int64 // port to unix time the user expires, from ss_user.expire
 	Timeout      int               `json:"timeout"`
+	// SIP003 plugin run in front of every port, and its options. The server
+	// can't be upgraded in place with SIGUSR2 when one is used.
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+	// built-in transport instead of a plugin: "" for plain tcp or "ws" for
+	// WebSocket on ws_path, over TLS if a certificate is given. Other http
+	// requests are proxied to decoy if it's a url, or served from it if it's
+	// a directory.
+	Transport string `json:"transport"`
+	WSPath    string `json:"ws_path"`
+	TLSCert   string `json:"tls_cert"`
+	TLSKey    string `json:"tls_key"`
+	Decoy     string `json:"decoy"`
+	// simple-obfs framing ("http" or "tls") for ports without their own
+	Obfs string `json:"obfs"`
+	// what to do with connections failing the handshake: "drain" (default)
+	// keeps reading for a while as a real server would, "close" hangs up
+	Probe     string            `json:"probe"`
+	PortProbe map[string]string `json:"port_probe"`
+	// clients failing the handshake ban_failures times (10, -1 to never ban)
+	// within ban_window seconds (60) get their /ban_prefix4 (32) or
+	// /ban_prefix6 (64) network banned for ban_time seconds (600). Bans are
+	// kept in ban_file across restarts if set. Loopback and ban_trusted
+	// addresses or networks are never banned. Nothing is banned for failures
+	// with a plugin or ws transport, as clients then come from the proxy.
+	BanFailures int      `json:"ban_failures"`
+	BanWindow   int      `json:"ban_window"`
+	BanTime     int      `json:"ban_time"`
+	BanPrefix4  int      `json:"ban_prefix4"`
+	BanPrefix6  int      `json:"ban_prefix6"`
+	BanFile     string   `json:"ban_file"`
+	BanTrusted  []string `json:"ban_trusted"`
+	// cidr ranges users may not connect to, DefaultBlockedCIDRs if omitted
+	OutboundBlock []string `json:"outbound_block"`
+	ACL           string   `json:"acl"` // destination rules, shadowsocks-libev acl format
+	// named destination rule sets users can be assigned to, name to acl
+	// file, checked after the outbound_block_list of acl
+	Policies map[string]string `json:"policies"`
+	// upstream proxies outbound connections can be routed through, name to
+	// url, and the one used when no acl route matches ("" for direct)
+	Upstreams map[string]string `json:"upstreams"`
+	Upstream  string            `json:"upstream"`
+	// local addresses outbound connections are made from, round-robin
+	OutboundBind []string `json:"outbound_bind"`
+	// resolver for outbound connections, see ResolverConfig
+	DNS        []string            `json:"dns"`
+	DNSPrefer  string              `json:"dns_prefer"`
+	DNSHosts   map[string][]string `json:"dns_hosts"`
+	DNSTimeout int                 `json:"dns_timeout"`
+	// seconds to wait for an outbound connection, 10 if not set
+	ConnectTimeout int `json:"connect_timeout"`
+	// seconds open connections get to finish on shutdown, 10 if not set
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// seconds between reloads of the users from the database, 60 if not set,
+	// negative to only reload on request
+	SyncInterval int `json:"sync_interval"`
+	// whether this node may run the billing cycle, archiving and resetting
+	// the traffic of users due according to ss_user.reset_day or
+	// reset_period. Of several such nodes, one at a time does.
+	BillingLeader bool `json:"billing_leader"`
 
 	// following options are only used by client
 
@@ -39,11 +106,33 @@ type Config struct {
 	ServerTag string	`json:"servertag"`
 	ServerAddr string	`json:"serveraddr"`
 	ServerID int64
+	// relay settings of this node, from ss_server. RelayMode is "" for a
+	// normal exit node, "raw" to forward users' traffic to RelayAddr as is,
+	// or "reencrypt" to decrypt it and send it on with the relay cipher.
+	RelayAddr     string
+	RelayMode     string
+	RelayMethod   string
+	RelayPassword string
 	DSN string			`json:"dsn"`
 }
-var readTimeout time.Duration
+// readTimeout is read by every pipe and may be changed on reload, so it's
+// accessed atomically, in nanoseconds.
+var readTimeout int64
 
+// ParseConfig reads the config file and the users of the server from the
+// database, opening it if db is nil. It also brings the database up to
+// date: users' active flags, the keepalive user and their ss_detail rows.
 func ParseConfig(path string,db *sql.DB) (config *Config, err error) {
+	return parseConfig(path, db, true)
+}
+
+// SyncConfig is ParseConfig without writing to the database, for the
+// periodic sync every node runs.
+func SyncConfig(path string, db *sql.DB) (*Config, error) {
+	return parseConfig(path, db, false)
+}
+
+func parseConfig(path string,db *sql.DB,update bool) (config *Config, err error) {
 	file, err := os.Open(path) // For read access.
 	if err != nil {
 		return
@@ -94,6 +183,10 @@ func ParseConfig(path string,db *sql.DB) (config *Config, err error) {
 		Debug.Println("mysql connected")
 		db.SetMaxOpenConns(20)
 		db.SetMaxIdleConns(15)
+		// Only at startup, reloads pass the server's connection.
+		if err = Migrate(db); err != nil {
+			return nil, err
+		}
 	}
 	//check server info exist in db. if not, check extern ip to register it.
 	err = chkServer(db,config)
@@ -101,13 +194,11 @@ func ParseConfig(path string,db *sql.DB) (config *Config, err error) {
 		return nil,err
 	}
 	//start connect to db to fetch users to port_password
-	pps,pus,err := fetchUsers(db,config)
+	err = fetchUsers(db,config,update)
 	if err!=nil {
 		return nil,err
 	}
-	config.PortPassword = pps
-	config.PortUID = pus
-	readTimeout = time.Duration(config.Timeout) * time.Second
+	SetTimeout(config.Timeout)
 	if strings.HasSuffix(strings.ToLower(config.Method), "-auth") {
 		config.Method = config.Method[:len(config.Method)-5]
 		config.Auth = true
@@ -116,14 +207,14 @@ func ParseConfig(path string,db *sql.DB) (config *Config, err error) {
 }
 
 func chkServer(db *sql.DB,config *Config) error {
-	stmt, err :=  db.Prepare("SELECT * FROM ss_server WHERE name = ? LIMIT 1;")
+	stmt, err :=  db.Prepare("SELECT id,name,addr,relay_addr,relay_mode,relay_method,relay_passwd FROM ss_server WHERE name = ? LIMIT 1;")
 	if err != nil {
 		return err
 	}
 	row := stmt.QueryRow(config.ServerTag)
-	err = row.Scan(&config.ServerID,&config.ServerTag,&config.ServerAddr)
+	err = row.Scan(&config.ServerID,&config.ServerTag,&config.ServerAddr,&config.RelayAddr,&config.RelayMode,&config.RelayMethod,&config.RelayPassword)
 	if err == nil {
-		return nil
+		return chkRelay(config)
 	}
 	if err != sql.ErrNoRows {
 		return err
@@ -141,10 +232,10 @@ func chkServer(db *sql.DB,config *Config) error {
 		return err
 	} else {
 		resp, err := http.Get("http://whatismyip.akamai.com/")
-		defer resp.Body.Close()
 		if err!=nil {
 			return fmt.Errorf("Cannot get server ext ip (via akamai). Please define serveraddr in config file instead.")
 		}
+		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err!= nil {
 			return fmt.Errorf("Get ext ip failed. Akamai return an error result")
@@ -154,36 +245,97 @@ func chkServer(db *sql.DB,config *Config) error {
 	}
 }
 
-func fetchUsers(db *sql.DB,config *Config) (map[string]string,map[string]string,error) {
+func chkRelay(config *Config) error {
+	switch config.RelayMode {
+	case "":
+		return nil
+	case "raw", "reencrypt":
+	default:
+		return fmt.Errorf("server %s: unknown relay_mode %q", config.ServerTag, config.RelayMode)
+	}
+	if config.RelayAddr == "" {
+		return fmt.Errorf("server %s: relay_mode %s needs a relay_addr", config.ServerTag, config.RelayMode)
+	}
+	if config.RelayMode == "reencrypt" {
+		if _, _, err := net.SplitHostPort(config.RelayAddr); err != nil {
+			return fmt.Errorf("server %s: relay_addr must be host:port to reencrypt", config.ServerTag)
+		}
+		if config.RelayMethod == "" || config.RelayPassword == "" {
+			return fmt.Errorf("server %s: relay_method and relay_passwd are needed to reencrypt", config.ServerTag)
+		}
+		if err := CheckCipherMethod(strings.TrimSuffix(config.RelayMethod, "-auth")); err != nil {
+			return fmt.Errorf("server %s: relay_method: %v", config.ServerTag, err)
+		}
+	}
+	return nil
+}
+
+// usersActive selects the users under their limit and not expired, what
+// fetchUsers sets the active flag from.
+const usersActive = "u + d < limits AND (expire = 0 OR expire > UNIX_TIMESTAMP())"
+
+// fetchUsers loads the active users into config. Unless update is set the
+// database is only read, and activity is worked out from usersActive.
+func fetchUsers(db *sql.DB,config *Config,update bool) error {
 	pps := make(map[string]string)
 	pus := make(map[string]string)
-	db.Exec("UPDATE ss_user SET active = 1 where u + d < limits and active=0;")
-	db.Exec("UPDATE ss_user SET active = 0 where u + d >= limits and active=1;")
-	db.Exec("DELETE from ss_user where email='keepalive@server' or port='18181';")
-	stmt, err := db.Prepare("INSERT INTO ss_user (name,email,password,port,passwd,limits,active) values ('keepalive','keepalive@server','1a2b3c4d5e6f',18181,?,100000000000,1);")
-	if err != nil {
-		return nil,nil,err
-	}
-	stmt.Exec(Krand(16,3))
-	if err !=nil {
-		return nil,nil,err
+	ppo := make(map[string]string)
+	ppe := make(map[string]string)
+	pob := make(map[string]string)
+	pme := make(map[string]string)
+	pex := make(map[string]int64)
+	query := "SELECT id,port,passwd,policy,egress_ip,obfs,method,expire FROM ss_user WHERE " + usersActive + ";"
+	if update {
+		db.Exec("UPDATE ss_user SET active = 1 where u + d < limits and (expire = 0 or expire > UNIX_TIMESTAMP()) and active=0;")
+		db.Exec("UPDATE ss_user SET active = 0 where (u + d >= limits or (expire > 0 and expire <= UNIX_TIMESTAMP())) and active=1;")
+		db.Exec("DELETE from ss_user where email='keepalive@server' or port='18181';")
+		stmt, err := db.Prepare("INSERT INTO ss_user (name,email,password,port,passwd,limits,active) values ('keepalive','keepalive@server','1a2b3c4d5e6f',18181,?,100000000000,1);")
+		if err != nil {
+			return err
+		}
+		stmt.Exec(Krand(16,3))
+		stmt.Close()
+		db.Exec(fmt.Sprintf("INSERT IGNORE INTO ss_detail (server_id, user_id) SELECT %d, id FROM ss_user WHERE active = 1",config.ServerID))
+		query = "SELECT id,port,passwd,policy,egress_ip,obfs,method,expire FROM ss_user WHERE active = 1;"
 	}
-	stmt.Close()
-	db.Exec(fmt.Sprintf("INSERT IGNORE INTO ss_detail (server_id, user_id) SELECT %d, id FROM ss_user WHERE active = 1",config.ServerID))   
-	rows, err := db.Query("SELECT id,port,passwd FROM ss_user WHERE active = 1;")
+	rows, err := db.Query(query)
     if err != nil {
-        return nil,nil,err
+        return err
     }
+	defer rows.Close()
 	for rows.Next() {
-        var k,v,u string
-        err = rows.Scan(&u, &k, &v)
+        var k,v,u,p,e,o,m string
+        var x int64
+        err = rows.Scan(&u, &k, &v, &p, &e, &o, &m, &x)
 		if k=="" || v=="" {
 			continue
 		}
 		pps[k]=v
 		pus[k]=u
+		if p!="" {
+			ppo[k]=p
+		}
+		if e!="" {
+			ppe[k]=e
+		}
+		if o!="" {
+			pob[k]=o
+		}
+		if m!="" {
+			pme[k]=m
+		}
+		if x>0 {
+			pex[k]=x
+		}
     }
-	return pps,pus,nil
+	config.PortPassword = pps
+	config.PortUID = pus
+	config.PortPolicy = ppo
+	config.PortEgress = ppe
+	config.PortObfs = pob
+	config.PortMethod = pme
+	config.PortExpire = pex
+	return nil
 }
 
 
@@ -191,6 +343,12 @@ func SetDebug(d DebugLog) {
 	Debug = d
 }
 
+// SetTimeout sets the read timeout used by the pipe functions, for programs
+// that don't read their options through ParseConfig.
+func SetTimeout(seconds int) {
+	atomic.StoreInt64(&readTimeout, int64(time.Duration(seconds)*time.Second))
+}
+
 // Useful for command line to override options specified in config file
 // Debug is not updated.
 func UpdateConfig(old, new *Config) {
@@ -224,8 +382,10 @@ func UpdateConfig(old, new *Config) {
 		}
 	}
 
-	old.Timeout = new.Timeout
-	readTimeout = time.Duration(old.Timeout) * time.Second
+	if new.Timeout != 0 {
+		old.Timeout = new.Timeout
+	}
+	SetTimeout(old.Timeout)
 }
 
 //Krand rand string，kind: 0 number 1 lowercase 2 uppercase 3 all before
@@ -63,6 +63,22 @@ func RawAddr(addr string) (buf []byte, err error) {
 	return
 }
 
+// RawAddrFromIP encodes an ip address and port the same way as RawAddr, using
+// the IPv4 or IPv6 address type instead of a domain name.
+func RawAddrFromIP(ip net.IP, port int) (buf []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = make([]byte, 1+net.IPv4len+2)
+		buf[0] = 1 // 1 means the address is ipv4
+		copy(buf[1:], ip4)
+	} else {
+		buf = make([]byte, 1+net.IPv6len+2)
+		buf[0] = 4 // 4 means the address is ipv6
+		copy(buf[1:], ip.To16())
+	}
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(port))
+	return
+}
+
 // This is intended for use by users implementing a local socks proxy.
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
@@ -71,11 +87,19 @@ func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, er
 	if err != nil {
 		return
 	}
+	return NewClientConn(conn, rawaddr, cipher)
+}
+
+// NewClientConn is like DialWithRawAddr, but uses an already established
+// connection to the server. The connection is closed if the request can't
+// be sent.
+func NewClientConn(conn net.Conn, rawaddr []byte, cipher *Cipher) (c *Conn, err error) {
 	c = NewConn(conn, cipher, "0")
 	if cipher.ota {
 		if c.enc == nil {
 			if _, err = c.initEncrypt(); err != nil {
-				return
+				c.Close()
+				return nil, err
 			}
 		}
 		// since we have initEncrypt, we must send iv manually
@@ -0,0 +1,160 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Classes of outbound connection failures, for logging and statistics.
+const (
+	FailTimeout     = "timeout"
+	FailRefused     = "refused"
+	FailUnreachable = "unreachable"
+	FailDNS         = "dns"
+	FailOther       = "other"
+)
+
+// DefaultAttemptDelay is the Connection Attempt Delay recommended by rfc8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// DialError is a failed outbound connection whose class is known up front,
+// such as a failed name lookup.
+type DialError struct {
+	Class string
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	return e.Class + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyDialError tells whether err, returned while connecting to a
+// target, was a timeout, a refused connection, an unreachable network or
+// host, or a DNS failure.
+func ClassifyDialError(err error) string {
+	var de *DialError
+	if errors.As(err, &de) {
+		return de.Class
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr), errors.Is(err, ErrNoSuchHost):
+		return FailDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return FailUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, syscall.ETIMEDOUT):
+		return FailTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return FailTimeout
+	}
+	return FailOther
+}
+
+// DialParallel connects to one of ips the way rfc8305 (Happy Eyeballs v2)
+// describes: the addresses are interleaved by family, starting with the
+// family of the first one, and a new attempt is started every delay, or as
+// soon as the previous one fails, until one connects. The others are then
+// abandoned. dial makes a single attempt and must honour ctx. The Resolver
+// puts IPv6 first unless dns_prefer says otherwise.
+//
+// The error of the first attempt is returned if all of them fail.
+func DialParallel(ctx context.Context, ips []net.IP, delay time.Duration,
+	dial func(ctx context.Context, ip net.IP) (net.Conn, error)) (net.Conn, error) {
+	ips = interleaveFamilies(ips)
+	if len(ips) == 0 {
+		return nil, errors.New("no address to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	var attempt <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial(ctx, ip)
+			results <- result{c, err}
+		}()
+		if next < len(ips) {
+			attempt = time.After(delay)
+		} else {
+			attempt = nil
+		}
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close attempts that still manage to connect.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		case <-attempt:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveFamilies reorders ips so IPv6 and IPv4 addresses alternate,
+// starting with the family of ips[0] and keeping the order within a family.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	got := interleaveFamilies(ips)
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+	hung := make(chan struct{})
+	start := time.Now()
+	c, err := DialParallel(context.Background(), ips, 50*time.Millisecond, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		if ip.To4() == nil {
+			// Black holed IPv6 route, only gives up when cancelled.
+			<-ctx.Done()
+			close(hung)
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("second attempt started after %v, before the attempt delay", d)
+	}
+	select {
+	case <-hung:
+	case <-time.After(time.Second):
+		t.Error("losing attempt was not cancelled")
+	}
+}
+
+func TestDialParallelFailFast(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	tried := 0
+	_, err := DialParallel(context.Background(), ips, time.Hour, func(ctx context.Context, ip net.IP) (net.Conn, error) {
+		tried++
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	})
+	if tried != 2 {
+		t.Errorf("%d attempts, want the next address tried right after a failure", tried)
+	}
+	if c := ClassifyDialError(err); c != FailRefused {
+		t.Errorf("class %s, want %s", c, FailRefused)
+	}
+	if c := ClassifyDialError(&DialError{FailDNS, errors.New("servfail")}); c != FailDNS {
+		t.Errorf("class %s, want %s", c, FailDNS)
+	}
+}
@@ -0,0 +1,114 @@
+package shadowsocks
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// schemaColumns are the columns added to the tables since the first
+// schema, in the order they came, for Migrate to add to older databases.
+var schemaColumns = []struct {
+	table, column, def string
+}{
+	{"ss_user", "policy", "varchar(32) NOT NULL DEFAULT ''"},
+	{"ss_server", "relay_addr", "varchar(100) NOT NULL DEFAULT ''"},
+	{"ss_server", "relay_mode", "varchar(10) NOT NULL DEFAULT ''"},
+	{"ss_server", "relay_method", "varchar(20) NOT NULL DEFAULT ''"},
+	{"ss_server", "relay_passwd", "varchar(128) NOT NULL DEFAULT ''"},
+	{"ss_user", "egress_ip", "varchar(100) NOT NULL DEFAULT ''"},
+	{"ss_user", "obfs", "varchar(8) NOT NULL DEFAULT ''"},
+	{"ss_user", "method", "varchar(32) NOT NULL DEFAULT ''"},
+	{"ss_user", "expire", "int(10) UNSIGNED NOT NULL DEFAULT 0"},
+	{"ss_user", "reset_day", "tinyint(3) UNSIGNED NOT NULL DEFAULT 0"},
+	{"ss_user", "reset_period", "smallint(5) UNSIGNED NOT NULL DEFAULT 0"},
+	{"ss_user", "last_reset", "int(10) UNSIGNED NOT NULL DEFAULT 0"},
+}
+
+// droppedKeys are the foreign keys, by table and name, that older versions
+// created and Migrate drops.
+var droppedKeys = []struct {
+	table, name string
+}{
+	{"ss_user_history", "uid02"},
+	{"ss_traffic", "uid03"},
+}
+
+// unsignedColumns are columns older versions created signed, by table,
+// name and definition, for Migrate to change.
+var unsignedColumns = []struct {
+	table, column, def string
+}{
+	{"ss_user_history", "d", "bigint(20) UNSIGNED NOT NULL"},
+}
+
+// SchemaTables creates the tables added since the first schema, if they
+// don't exist yet. ss_user_history has no foreign key to ss_user, the
+// billing archive of a user outlives them. Neither has ss_traffic: a row of
+// a user deleted meanwhile mustn't fail the other rows saved with it.
+var SchemaTables = []string{
+	"CREATE TABLE IF NOT EXISTS `ss_user_history` ( `id` int(10) UNSIGNED NOT NULL AUTO_INCREMENT, `user_id` int(10) UNSIGNED NOT NULL, `period_start` int(10) UNSIGNED NOT NULL, `period_end` int(10) UNSIGNED NOT NULL, `u` bigint(20) UNSIGNED NOT NULL, `d` bigint(20) UNSIGNED NOT NULL, `ue` bigint(20) UNSIGNED NOT NULL, `de` bigint(20) UNSIGNED NOT NULL, `limits` bigint(20) UNSIGNED NOT NULL, PRIMARY KEY (`id`), KEY `user_period` (`user_id`,`period_end`)) ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+	"CREATE TABLE IF NOT EXISTS `ss_traffic` ( `id` int(10) UNSIGNED NOT NULL AUTO_INCREMENT, `server_id` int(10) UNSIGNED NOT NULL, `user_id` int(10) UNSIGNED NOT NULL, `hour` int(10) UNSIGNED NOT NULL, `u` bigint(20) UNSIGNED NOT NULL DEFAULT 0, `d` bigint(20) UNSIGNED NOT NULL DEFAULT 0, `ue` bigint(20) UNSIGNED NOT NULL DEFAULT 0, `de` bigint(20) UNSIGNED NOT NULL DEFAULT 0, PRIMARY KEY (`id`), UNIQUE KEY `user_hour` (`user_id`,`server_id`,`hour`), KEY `server_hour` (`server_id`,`hour`), CONSTRAINT `sid03` FOREIGN KEY (`server_id`) REFERENCES `ss_server` (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8;",
+}
+
+// Migrate brings the schema of a database made by an older version up to
+// date, adding the missing columns and tables. It is run when the server
+// starts. A database without the tables is left to be initialized.
+func Migrate(db *sql.DB) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'ss_user'").Scan(&n)
+	if err != nil {
+		return fmt.Errorf("migrate: %v", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	for _, c := range schemaColumns {
+		err = db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+			c.table, c.column).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", c.table, c.column, c.def)); err != nil {
+			return fmt.Errorf("migrate: adding %s.%s: %v", c.table, c.column, err)
+		}
+		log.Printf("migrate: added column %s.%s\n", c.table, c.column)
+	}
+	for _, stmt := range SchemaTables {
+		if _, err = db.Exec(stmt); err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+	}
+	for _, fk := range droppedKeys {
+		err = db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLE_CONSTRAINTS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = ? AND CONSTRAINT_TYPE = 'FOREIGN KEY'",
+			fk.table, fk.name).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP FOREIGN KEY `%s`", fk.table, fk.name)); err != nil {
+			return fmt.Errorf("migrate: dropping %s.%s: %v", fk.table, fk.name, err)
+		}
+		log.Printf("migrate: dropped foreign key %s.%s\n", fk.table, fk.name)
+	}
+	for _, c := range unsignedColumns {
+		err = db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ? AND COLUMN_TYPE NOT LIKE '%unsigned%'",
+			c.table, c.column).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN `%s` %s", c.table, c.column, c.def)); err != nil {
+			return fmt.Errorf("migrate: changing %s.%s: %v", c.table, c.column, err)
+		}
+		log.Printf("migrate: made %s.%s unsigned\n", c.table, c.column)
+	}
+	return nil
+}
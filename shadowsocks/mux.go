@@ -0,0 +1,467 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MuxAddr is the target a client requests to start a multiplexed session
+// instead of a single connection. The .invalid tld can't be a real target.
+const MuxAddr = "mux.ssgo.invalid:0"
+
+// Frames of a mux session, smux style: version, command, payload length
+// and stream id, followed by the payload.
+const (
+	muxVersion   = 1
+	muxHeaderLen = 8
+
+	muxSYN = 0 // open a stream
+	muxFIN = 1 // sender closed the stream
+	muxPSH = 2 // data
+	muxNOP = 3 // keepalive
+	muxUPD = 4 // receiver consumed n bytes, payload is n
+
+	muxMaxPayload = 16 * 1024
+	// bytes a stream may have in flight before the receiver acknowledges
+	// them, so one slow stream can't stall the others
+	muxWindow = 256 * 1024
+	// streams waiting to be accepted before new ones are refused
+	muxAcceptBacklog = 1024
+	// open streams of a server session before new ones are refused, which
+	// with muxWindow bounds the memory one client can hold
+	muxMaxStreams = 128
+)
+
+// how often a client session sends a keepalive, so a server session with
+// no traffic isn't closed as idle
+var muxKeepalive = 15 * time.Second
+
+var (
+	errMuxClosed   = errors.New("mux: session closed")
+	errMuxProtocol = errors.New("mux: protocol error")
+)
+
+// MuxSession carries many streams over one connection, which for
+// shadowsocks is an encrypted Conn to MuxAddr.
+type MuxSession struct {
+	conn   net.Conn
+	client bool
+
+	wmu sync.Mutex // serializes frames
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	err     error
+	die     chan struct{}
+
+	accept chan *MuxStream
+	// timeout before a server session with no frames is closed
+	idle time.Duration
+}
+
+// NewMuxClient starts the client side of a session, opening streams.
+func NewMuxClient(conn net.Conn) *MuxSession {
+	return newMuxSession(conn, true, 0)
+}
+
+// NewMuxServer starts the server side of a session, accepting streams.
+// The session is closed if the client sends nothing for idle, unless zero.
+// Clients send keepalives, so only dead sessions time out. Streams beyond
+// muxMaxStreams open at once are refused.
+func NewMuxServer(conn net.Conn, idle time.Duration) *MuxSession {
+	return newMuxSession(conn, false, idle)
+}
+
+func newMuxSession(conn net.Conn, client bool, idle time.Duration) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  1, // clients open odd streams
+		die:     make(chan struct{}),
+		accept:  make(chan *MuxStream, muxAcceptBacklog),
+		idle:    idle,
+	}
+	go s.recvLoop()
+	if client {
+		go s.keepalive(muxKeepalive)
+	}
+	return s
+}
+
+func (s *MuxSession) keepalive(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if s.writeFrame(muxNOP, 0, nil) != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// Open starts a new stream.
+func (s *MuxSession) Open() (*MuxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(muxSYN, id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *MuxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed tells whether the session has ended.
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close ends the session and all its streams.
+func (s *MuxSession) Close() error {
+	s.fail(errMuxClosed)
+	return nil
+}
+
+func (s *MuxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *MuxSession) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	close(s.die)
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// RemoteAddr returns the address of the peer of the session.
+func (s *MuxSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *MuxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	hdr := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	hdr[0] = muxVersion
+	hdr[1] = cmd
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(append(hdr, payload...)); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (s *MuxSession) recvLoop() {
+	var hdr [muxHeaderLen]byte
+	for {
+		if s.idle > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.idle))
+		}
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		if hdr[0] != muxVersion {
+			s.fail(errMuxProtocol)
+			return
+		}
+		cmd := hdr[1]
+		n := binary.BigEndian.Uint16(hdr[2:])
+		id := binary.BigEndian.Uint32(hdr[4:])
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(err)
+			return
+		}
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch cmd {
+		case muxSYN:
+			if s.client || st != nil || id%2 == 0 {
+				s.fail(errMuxProtocol)
+				return
+			}
+			st = newMuxStream(s, id)
+			s.mu.Lock()
+			full := len(s.streams) >= muxMaxStreams
+			if !full {
+				s.streams[id] = st
+			}
+			s.mu.Unlock()
+			if full {
+				s.writeFrame(muxFIN, id, nil)
+				continue
+			}
+			select {
+			case s.accept <- st:
+			default:
+				s.forget(id)
+				s.writeFrame(muxFIN, id, nil)
+			}
+		case muxPSH:
+			if st != nil && !st.push(payload) {
+				s.fail(errMuxProtocol)
+				return
+			}
+		case muxFIN:
+			if st != nil {
+				st.remoteClose()
+			}
+		case muxUPD:
+			if len(payload) != 4 {
+				s.fail(errMuxProtocol)
+				return
+			}
+			if st != nil {
+				st.acked(binary.BigEndian.Uint32(payload))
+			}
+		case muxNOP:
+		default:
+			s.fail(errMuxProtocol)
+			return
+		}
+	}
+}
+
+func (s *MuxSession) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// MuxStream is one logical connection of a session.
+type MuxStream struct {
+	s  *MuxSession
+	id uint32
+
+	mu           sync.Mutex
+	buf          []byte // received, not yet read
+	consumed     uint32 // read since the last window update
+	inflight     int    // sent, not yet acknowledged
+	finRecv      bool
+	closed       bool
+	readDeadline time.Time
+
+	readable chan struct{} // data, fin or close
+	writable chan struct{} // window update or close
+}
+
+func newMuxStream(s *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		s:        s,
+		id:       id,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push queues received data, false if the peer overran the window.
+func (st *MuxStream) push(b []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.buf)+len(b) > muxWindow {
+		return false
+	}
+	st.buf = append(st.buf, b...)
+	notify(st.readable)
+	return true
+}
+
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *MuxStream) acked(n uint32) {
+	st.mu.Lock()
+	st.inflight -= int(n)
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.consumed += uint32(n)
+			var upd []byte
+			if st.consumed >= muxWindow/2 {
+				upd = make([]byte, 4)
+				binary.BigEndian.PutUint32(upd, st.consumed)
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if upd != nil {
+				st.s.writeFrame(muxUPD, st.id, upd)
+			}
+			return n, nil
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if st.finRecv {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-st.readable:
+		case <-timeout:
+		case <-st.s.die:
+			return 0, st.s.closeErr()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (st *MuxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		if st.closed || st.finRecv {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		room := muxWindow - st.inflight
+		if room <= 0 {
+			st.mu.Unlock()
+			select {
+			case <-st.writable:
+			case <-st.s.die:
+				return written, st.s.closeErr()
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > room {
+			n = room
+		}
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		st.inflight += n
+		st.mu.Unlock()
+		if err := st.s.writeFrame(muxPSH, st.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.s.forget(st.id)
+	return st.s.writeFrame(muxFIN, st.id, nil)
+}
+
+func (st *MuxStream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *MuxStream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	return st.SetReadDeadline(t)
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+// SetWriteDeadline is not supported, writes only block on the peer's window.
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,229 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T) (client, server *MuxSession) {
+	c1, c2 := net.Pipe()
+	return NewMuxClient(c1), NewMuxServer(c2, 0)
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := muxPair(t)
+	defer client.Close()
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	// More than a window per stream, so the echo only completes if window
+	// updates flow.
+	const size = muxWindow*2 + 1000
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			msg := bytes.Repeat([]byte{byte(i)}, size)
+			go st.Write(msg)
+			got := make([]byte, size)
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Errorf("stream %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("stream %d: data mixed up", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamDeadlineAndClose(t *testing.T) {
+	client, server := muxPair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	peer.Write([]byte("bye"))
+	peer.Close()
+	st.SetReadDeadline(time.Time{})
+	b, err := io.ReadAll(st)
+	if err != nil || string(b) != "bye" {
+		t.Errorf("got %q, %v; want data then EOF", b, err)
+	}
+	client.Close()
+	if _, err = server.Accept(); err == nil {
+		t.Error("accept succeeded on a closed session")
+	}
+}
+
+func TestMuxStreamLimit(t *testing.T) {
+	client, server := muxPair(t)
+	defer client.Close()
+	defer server.Close()
+	var streams []*MuxStream
+	for i := 0; i <= muxMaxStreams; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+	extra := streams[muxMaxStreams]
+	extra.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stream over the limit: got %v, want EOF", err)
+	}
+	if n := server.NumStreams(); n != muxMaxStreams {
+		t.Errorf("server has %d streams, want %d", n, muxMaxStreams)
+	}
+	// Closing one makes room for another.
+	streams[0].Close()
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Close()
+	deadline := time.Now().Add(time.Second)
+	for server.NumStreams() >= muxMaxStreams && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("x"))
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("stream after one closed: got %v, want it open", err)
+	}
+}
+
+func TestMuxKeepalive(t *testing.T) {
+	defer func(d time.Duration) { muxKeepalive = d }(muxKeepalive)
+	muxKeepalive = 10 * time.Millisecond
+	c1, c2 := net.Pipe()
+	client, server := NewMuxClient(c1), NewMuxServer(c2, 50*time.Millisecond)
+	defer client.Close()
+	time.Sleep(200 * time.Millisecond)
+	if server.IsClosed() || client.IsClosed() {
+		t.Fatal("idle session with keepalives was closed")
+	}
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if _, err = server.Accept(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxOTA(t *testing.T) {
+	cipher, err := NewCipher("aes-128-cfb-auth", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDialer("127.0.0.1:1", cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetMux(1, 8)
+	if c, err := d.Dial("tcp", "example.com:80"); err == nil {
+		c.Close()
+		t.Error("mux dial with one time auth succeeded")
+	}
+}
+
+// heldDialer counts dials and holds each one until release is closed.
+type heldDialer struct {
+	dials   int32
+	release chan struct{}
+}
+
+func (h *heldDialer) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+func (h *heldDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&h.dials, 1)
+	select {
+	case <-h.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, b)
+	return a, nil
+}
+
+func TestMuxPendingDials(t *testing.T) {
+	cipher, _ := NewCipher("aes-256-cfb", "foobar")
+	held := &heldDialer{release: make(chan struct{})}
+	d := &Dialer{cipher: cipher, server: "127.0.0.1:8388", forward: held}
+	d.SetMux(1, 8)
+
+	sessions := make(chan *MuxSession, 4)
+	for i := 0; i < cap(sessions); i++ {
+		go func() {
+			s, err := d.muxSession(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			sessions <- s
+		}()
+	}
+	// the dial of the first caller is pending, a canceled one gives up
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.muxSession(ctx); err != context.Canceled {
+		t.Errorf("canceled wait returned %v", err)
+	}
+	close(held.release)
+	first := <-sessions
+	for i := 1; i < cap(sessions); i++ {
+		if s := <-sessions; s != first {
+			t.Error("callers got different sessions")
+		}
+	}
+	if first != nil {
+		first.Close()
+	}
+	if n := atomic.LoadInt32(&held.dials); n != 1 {
+		t.Errorf("%d dials, want 1", n)
+	}
+}
@@ -0,0 +1,389 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Obfuscation modes of simple-obfs, the obfs= plugin option.
+const (
+	ObfsHTTP = "http"
+	ObfsTLS  = "tls"
+)
+
+// CheckObfsMode returns an error if mode is not "" (none), ObfsHTTP or
+// ObfsTLS.
+func CheckObfsMode(mode string) error {
+	switch mode {
+	case "", ObfsHTTP, ObfsTLS:
+		return nil
+	}
+	return fmt.Errorf("unsupported obfs %q", mode)
+}
+
+var errObfsHandshake = errors.New("obfs: bad handshake")
+
+// NewObfsClientConn wraps conn, connected to a simple-obfs server, in the
+// given framing. host is sent as the Host header or the TLS server name.
+// The handshake is sent along with the first write.
+func NewObfsClientConn(conn net.Conn, mode, host string) net.Conn {
+	switch mode {
+	case ObfsHTTP:
+		return &obfsHTTPConn{Conn: conn, r: bufio.NewReader(conn), host: host}
+	case ObfsTLS:
+		return &obfsTLSConn{Conn: conn, host: host}
+	}
+	return conn
+}
+
+// NewObfsServerConn wraps conn, accepted from a simple-obfs client, in the
+// given framing.
+func NewObfsServerConn(conn net.Conn, mode string) net.Conn {
+	switch mode {
+	case ObfsHTTP:
+		return &obfsHTTPConn{Conn: conn, r: bufio.NewReader(conn), server: true}
+	case ObfsTLS:
+		return &obfsTLSConn{Conn: conn, server: true}
+	}
+	return conn
+}
+
+// obfsHTTPConn disguises the stream as a WebSocket upgrade: the first
+// payload follows a GET request, the first reply follows a 101 response,
+// after which data flows unframed.
+type obfsHTTPConn struct {
+	net.Conn
+	r      *bufio.Reader
+	host   string
+	server bool
+	read   bool // headers of the other side consumed
+	wrote  bool // own headers sent
+}
+
+// NetConn returns the connection under the framing.
+func (c *obfsHTTPConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var obfsUserAgents = []string{
+	"curl/7.64.1",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/115.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 16_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+}
+
+func obfsRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	if !c.read {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+		c.read = true
+	}
+	return c.r.Read(b)
+}
+
+// readHeader consumes the request or response header. The body, if any,
+// is the start of the stream.
+func (c *obfsHTTPConn) readHeader() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if c.server && !strings.HasPrefix(line, "GET ") && !strings.HasPrefix(line, "POST ") ||
+		!c.server && !strings.HasPrefix(line, "HTTP/1.") {
+		return errObfsHandshake
+	}
+	for n := 0; ; n++ {
+		if line, err = c.r.ReadString('\n'); err != nil {
+			return err
+		}
+		if line == "\r\n" || line == "\n" {
+			return nil
+		}
+		if n > 64 {
+			return errObfsHandshake
+		}
+	}
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	if c.wrote {
+		return c.Conn.Write(b)
+	}
+	c.wrote = true
+	var hdr bytes.Buffer
+	if c.server {
+		fmt.Fprintf(&hdr, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Server: nginx/1.18.0\r\n"+
+			"Date: %s\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+			time.Now().UTC().Format(time.RFC1123), base64.StdEncoding.EncodeToString(obfsRandom(20)))
+	} else {
+		ua := obfsUserAgents[int(obfsRandom(1)[0])%len(obfsUserAgents)]
+		fmt.Fprintf(&hdr, "GET / HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"User-Agent: %s\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: %s\r\n"+
+			"Content-Length: %d\r\n\r\n",
+			c.host, ua, base64.StdEncoding.EncodeToString(obfsRandom(16)), len(b))
+	}
+	hdr.Write(b)
+	if _, err := c.Conn.Write(hdr.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TLS record types used by the tls framing.
+const (
+	tlsChangeCipherSpec = 0x14
+	tlsHandshake        = 0x16
+	tlsApplicationData  = 0x17
+	// largest record payload we send, the tls limit is 2^14
+	tlsMaxPayload = 16 * 1024
+)
+
+// obfsTLSConn disguises the stream as a TLS 1.2 session resumed with a
+// session ticket: the client's first payload travels as the ticket in its
+// ClientHello, the rest as application data records.
+type obfsTLSConn struct {
+	net.Conn
+	host   string
+	server bool
+
+	hello     bool   // ClientHello sent or received
+	finished  bool   // client: ChangeCipherSpec and Finished sent
+	wrote     bool   // server: ServerHello sent
+	sessionID []byte // echoed by the server
+	pending   []byte // payload of the current record not yet read
+}
+
+// NetConn returns the connection under the framing.
+func (c *obfsTLSConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	if c.server && !c.hello {
+		c.hello = true
+		ticket, err := c.readClientHello()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = ticket
+	}
+	for len(c.pending) == 0 {
+		typ, payload, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		// Handshake messages and ChangeCipherSpec carry nothing for us.
+		if typ == tlsApplicationData {
+			c.pending = payload
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *obfsTLSConn) readRecord() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] < tlsChangeCipherSpec || hdr[0] > tlsApplicationData || hdr[1] != 3 {
+		return 0, nil, errObfsHandshake
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// readClientHello returns the session ticket of a ClientHello, which is
+// where the first payload is.
+func (c *obfsTLSConn) readClientHello() ([]byte, error) {
+	typ, rec, err := c.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	// type(1) length(3) version(2) random(32)
+	if typ != tlsHandshake || len(rec) < 38 || rec[0] != 1 {
+		return nil, errObfsHandshake
+	}
+	p := rec[38:]
+	skip := func(lenBytes int) bool {
+		if len(p) < lenBytes {
+			return false
+		}
+		n := 0
+		for _, b := range p[:lenBytes] {
+			n = n<<8 | int(b)
+		}
+		if len(p) < lenBytes+n {
+			return false
+		}
+		if lenBytes == 1 && c.sessionID == nil {
+			c.sessionID = append([]byte{}, p[1:1+n]...)
+		}
+		p = p[lenBytes+n:]
+		return true
+	}
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) || len(p) < 2 {
+		return nil, errObfsHandshake
+	}
+	p = p[2:]
+	for len(p) >= 4 {
+		ext := binary.BigEndian.Uint16(p)
+		n := int(binary.BigEndian.Uint16(p[2:]))
+		if len(p) < 4+n {
+			break
+		}
+		if ext == 0x0023 {
+			return p[4 : 4+n], nil
+		}
+		p = p[4+n:]
+	}
+	return nil, errObfsHandshake
+}
+
+func appendRecord(buf []byte, typ byte, payload []byte) []byte {
+	buf = append(buf, typ, 3, 3, byte(len(payload)>>8), byte(len(payload)))
+	return append(buf, payload...)
+}
+
+// appendAppData frames b as application data records.
+func appendAppData(buf, b []byte) []byte {
+	for len(b) > 0 {
+		n := len(b)
+		if n > tlsMaxPayload {
+			n = tlsMaxPayload
+		}
+		buf = appendRecord(buf, tlsApplicationData, b[:n])
+		b = b[n:]
+	}
+	return buf
+}
+
+// appendFinished adds ChangeCipherSpec and the (random, as if encrypted)
+// Finished message.
+func appendFinished(buf []byte) []byte {
+	buf = appendRecord(buf, tlsChangeCipherSpec, []byte{1})
+	return appendRecord(buf, tlsHandshake, obfsRandom(32))
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	var out []byte
+	data := b
+	switch {
+	case c.server && !c.wrote:
+		c.wrote = true
+		out = c.appendServerHello(out)
+		out = appendFinished(out)
+	case !c.server && !c.hello:
+		c.hello = true
+		n := len(data)
+		if n > tlsMaxPayload-512 {
+			n = tlsMaxPayload - 512
+		}
+		out = c.appendClientHello(out, data[:n])
+		data = data[n:]
+		if len(data) == 0 {
+			break
+		}
+		fallthrough
+	case !c.server && !c.finished:
+		c.finished = true
+		out = appendFinished(out)
+	}
+	out = appendAppData(out, data)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// tlsRandom is a ClientHello or ServerHello random: a timestamp and 28
+// random bytes.
+func tlsRandom() []byte {
+	r := obfsRandom(32)
+	binary.BigEndian.PutUint32(r, uint32(time.Now().Unix()))
+	return r
+}
+
+func (c *obfsTLSConn) appendClientHello(buf, ticket []byte) []byte {
+	var ext []byte
+	ext = appendExtension(ext, 0x0023, ticket) // session ticket
+	host := []byte(c.host)
+	sni := []byte{byte((len(host) + 3) >> 8), byte(len(host) + 3), 0, byte(len(host) >> 8), byte(len(host))}
+	ext = appendExtension(ext, 0x0000, append(sni, host...))
+	ext = appendExtension(ext, 0x000b, []byte{3, 0, 1, 2})                               // ec point formats
+	ext = appendExtension(ext, 0x000a, []byte{0, 8, 0, 0x1d, 0, 0x17, 0, 0x19, 0, 0x18}) // groups
+	ext = appendExtension(ext, 0x000d, []byte{0, 0x14, 6, 1, 6, 3, 5, 1, 5, 3, 4, 1, 4, 3, 3, 1, 3, 3, 2, 1, 2, 3})
+	ext = appendExtension(ext, 0x0016, nil) // encrypt then mac
+	ext = appendExtension(ext, 0x0017, nil) // extended master secret
+
+	suites := []byte{
+		0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+		0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+		0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+		0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+	}
+	var body []byte
+	body = append(body, 3, 3)
+	body = append(body, tlsRandom()...)
+	body = append(body, 32)
+	body = append(body, obfsRandom(32)...)
+	body = append(body, byte(len(suites)>>8), byte(len(suites)))
+	body = append(body, suites...)
+	body = append(body, 1, 0) // null compression
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+	return appendRecord(buf, tlsHandshake, handshakeMessage(1, body))
+}
+
+func (c *obfsTLSConn) appendServerHello(buf []byte) []byte {
+	sid := c.sessionID
+	if len(sid) != 32 {
+		sid = obfsRandom(32)
+	}
+	var body []byte
+	body = append(body, 3, 3)
+	body = append(body, tlsRandom()...)
+	body = append(body, 32)
+	body = append(body, sid...)
+	body = append(body, 0xcc, 0xa8, 0)             // ECDHE-RSA-CHACHA20-POLY1305, null compression
+	body = append(body, 0, 5, 0xff, 0x01, 0, 1, 0) // renegotiation info
+	return appendRecord(buf, tlsHandshake, handshakeMessage(2, body))
+}
+
+func handshakeMessage(typ byte, body []byte) []byte {
+	n := len(body)
+	return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func appendExtension(buf []byte, typ uint16, data []byte) []byte {
+	buf = append(buf, byte(typ>>8), byte(typ), byte(len(data)>>8), byte(len(data)))
+	return append(buf, data...)
+}
@@ -0,0 +1,99 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestObfsRoundTrip(t *testing.T) {
+	for _, mode := range []string{ObfsHTTP, ObfsTLS} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c = NewObfsServerConn(c, mode)
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewObfsClientConn(raw, mode, "www.example.com")
+		// Small first write, then one spanning several tls records.
+		for _, n := range []int{100, 40000} {
+			msg := bytes.Repeat([]byte{byte(n)}, n)
+			if _, err = c.Write(msg); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			got := make([]byte, n)
+			if _, err = io.ReadFull(c, got); err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("%s: %d bytes echoed differently", mode, n)
+			}
+		}
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestObfsRejectsPlain(t *testing.T) {
+	for _, mode := range []string{ObfsHTTP, ObfsTLS} {
+		c1, c2 := net.Pipe()
+		go func() {
+			c1.Write([]byte("\x05\x01\x00 not obfuscated at all\r\n\r\n"))
+			c1.Close()
+		}()
+		if _, err := NewObfsServerConn(c2, mode).Read(make([]byte, 64)); err != errObfsHandshake {
+			t.Errorf("%s: got %v, want a handshake error", mode, err)
+		}
+	}
+}
+
+func TestObfsUpstream(t *testing.T) {
+	cipher, _ := NewCipher("aes-128-cfb", "foobar")
+	for _, c := range []struct {
+		rawurl, mode string
+	}{
+		{"ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=obfs-local;obfs=http;obfs-host=www.example.com", ObfsHTTP},
+		{"ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=obfs-local%3Bobfs%3Dtls%3Bobfs-host%3Dwww.example.com", ObfsTLS},
+	} {
+		// The server only understands obfuscated shadowsocks.
+		server := fakeProxy(func(raw net.Conn) {
+			sc := NewConn(NewObfsServerConn(raw, c.mode), cipher.Copy(), "0")
+			want, _ := RawAddr("example.com:80")
+			if _, err := io.ReadFull(sc, make([]byte, len(want))); err != nil {
+				return
+			}
+			io.Copy(sc, sc)
+		})
+		up, err := NewUpstream(c.rawurl, server)
+		if err != nil {
+			t.Fatal(c.rawurl, err)
+		}
+		if d := up.(*Dialer); d.obfs != c.mode || d.obfsHost != "www.example.com" {
+			t.Fatalf("%s: obfs %q host %q", c.rawurl, d.obfs, d.obfsHost)
+		}
+		conn, err := up.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(c.rawurl, err)
+		}
+		echoed(t, conn)
+		conn.Close()
+	}
+	if _, err := NewUpstream("ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=obfs-local;obfs=ftp", nil); err == nil {
+		t.Error("accepted an unknown obfs mode")
+	}
+	if _, err := NewUpstream("ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=obfs-local;obfs-host=a", nil); err == nil {
+		t.Error("accepted obfs-local without a mode")
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
+	if d := time.Duration(atomic.LoadInt64(&readTimeout)); d != 0 {
+		c.SetReadDeadline(time.Now().Add(d))
 	}
 }
 
@@ -111,6 +112,32 @@ func PipeThenClose2(src net.Conn, dst *Conn) {
 	}
 }
 
+// PipeThenCloseStat copies data from src to dst, closes dst when done. The
+// data is counted as traffic of port, as upload if up is true.
+func PipeThenCloseStat(src, dst net.Conn, port string, up bool) {
+	defer dst.Close()
+	buf := leakyBuf.Get()
+	defer leakyBuf.Put(buf)
+	for {
+		SetReadTimeout(src)
+		n, err := src.Read(buf)
+		if n > 0 {
+			if up {
+				updateU(port, n)
+			} else {
+				updateD(port, n)
+			}
+			if _, err := dst.Write(buf[0:n]); err != nil {
+				Debug.Println("write:", err)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
 // PipeThenCloseOta copies data from src to dst, closes dst when done, with ota verification.
 func PipeThenCloseOta(src *Conn, dst net.Conn) {
 	const (
@@ -0,0 +1,152 @@
+package shadowsocks
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pluginMinBackoff = time.Second
+	pluginMaxBackoff = 30 * time.Second
+	// a plugin that ran at least this long starts over at the shortest delay
+	pluginStableRun = time.Minute
+)
+
+var errPluginStopped = errors.New("plugin stopped")
+
+// Plugin is a running SIP003 plugin process, e.g. simple-obfs or
+// v2ray-plugin. The plugin listens on the remote address, the one clients
+// (or, on a client, the server) see, and forwards to the local address,
+// where plain shadowsocks is spoken. It is restarted whenever it exits until
+// Stop is called.
+type Plugin struct {
+	path string
+	env  []string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// StartPlugin starts the plugin executable path with SIP003 environment
+// variables for the given addresses and opts as SS_PLUGIN_OPTIONS.
+func StartPlugin(path, opts, remoteHost, remotePort, localHost, localPort string) (*Plugin, error) {
+	p := &Plugin{
+		path: path,
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+remoteHost,
+			"SS_REMOTE_PORT="+remotePort,
+			"SS_LOCAL_HOST="+localHost,
+			"SS_LOCAL_PORT="+localPort,
+			"SS_PLUGIN_OPTIONS="+opts,
+		),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+// start runs the plugin, unless it has been stopped. Holding the lock while
+// starting makes sure Stop always sees the latest process.
+func (p *Plugin) start() (*exec.Cmd, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, errPluginStopped
+	}
+	cmd := exec.Command(p.path)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.cmd = cmd
+	return cmd, nil
+}
+
+func (p *Plugin) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+func (p *Plugin) supervise(cmd *exec.Cmd) {
+	defer close(p.done)
+	backoff := pluginMinBackoff
+	for {
+		started := time.Now()
+		err := cmd.Wait()
+		if p.isStopped() {
+			return
+		}
+		log.Printf("plugin %s (pid %d) exited: %v\n", p.path, cmd.Process.Pid, err)
+		if time.Since(started) >= pluginStableRun {
+			backoff = pluginMinBackoff
+		}
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			if backoff *= 2; backoff > pluginMaxBackoff {
+				backoff = pluginMaxBackoff
+			}
+			if cmd, err = p.start(); err == nil {
+				log.Printf("plugin %s restarted, pid %d\n", p.path, cmd.Process.Pid)
+				break
+			}
+			if err == errPluginStopped {
+				return
+			}
+			log.Printf("error restarting plugin %s: %v\n", p.path, err)
+		}
+	}
+}
+
+// Stop kills the plugin and waits for it to exit.
+func (p *Plugin) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.stop)
+	cmd := p.cmd
+	p.mu.Unlock()
+	// SIP003 plugins are expected to exit cleanly on SIGTERM.
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(3 * time.Second):
+		cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// FreeLoopbackPort finds a tcp port on 127.0.0.1 that is not in use, for a
+// plugin to listen on.
+func FreeLoopbackPort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), nil
+}
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestPluginHelper is the dummy plugin started by TestPlugin: it forwards
+// connections from the remote address to the local one, as SIP003 plugins
+// do, if it was given the expected options.
+func TestPluginHelper(t *testing.T) {
+	if os.Getenv("SSGO_PLUGIN_HELPER") != "1" {
+		return
+	}
+	if os.Getenv("SS_PLUGIN_OPTIONS") != "opt=1" {
+		os.Exit(2)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT")))
+	if err != nil {
+		os.Exit(3)
+	}
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			os.Exit(4)
+		}
+		go func() {
+			defer c.Close()
+			r, err := net.Dial("tcp", local)
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			go io.Copy(r, c)
+			io.Copy(c, r)
+		}()
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	// The plugin path takes no arguments, so a script passes them on.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	script := filepath.Join(t.TempDir(), "plugin")
+	err = os.WriteFile(script, []byte("#!/bin/sh\nexec '"+exe+"' -test.run='^TestPluginHelper$'\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSGO_PLUGIN_HELPER", "1")
+
+	// the shadowsocks side, answering "pong"
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("pong"))
+			c.Close()
+		}
+	}()
+	remote, err := FreeLoopbackPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, local, _ := net.SplitHostPort(server.Addr().String())
+	p, err := StartPlugin(script, "opt=1", "127.0.0.1", remote, "127.0.0.1", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := p.cmd.Process.Pid
+
+	var c net.Conn
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if c, err = net.Dial("tcp", "127.0.0.1:"+remote); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		p.Stop()
+		t.Fatal("plugin never listened:", err)
+	}
+	buf, _ := io.ReadAll(c)
+	c.Close()
+	if string(buf) != "pong" {
+		t.Errorf("read %q through the plugin, want pong", buf)
+	}
+
+	p.Stop()
+	if err = syscall.Kill(pid, 0); err == nil {
+		t.Errorf("plugin pid %d still running after Stop", pid)
+	}
+	if c, err = net.Dial("tcp", "127.0.0.1:"+remote); err == nil {
+		c.Close()
+		t.Error("plugin port still open after Stop")
+	}
+	p.Stop() // stopping twice is fine
+}
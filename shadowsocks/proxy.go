@@ -1,10 +1,12 @@
 package shadowsocks
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -12,6 +14,10 @@ type Dialer struct {
 	cipher *Cipher
 	server string
 	support_udp bool
+	forward ConnDialer // how to reach server, net.Dial if nil
+	ws *WSConfig // WebSocket transport, plain tcp if nil
+	obfs, obfsHost string // simple-obfs framing, none if empty
+	mux *muxPool // multiplexed sessions, a connection per dial if nil
 }
 
 type ProxyConn struct {
@@ -39,8 +45,17 @@ func NewDialer(server string, cipher *Cipher) (dialer *Dialer, err error) {
 }
 
 func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, giving up on connecting to the server when ctx
+// is done.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	if strings.HasPrefix(network, "tcp") && d.mux != nil {
+		return d.dialMux(ctx, network, addr)
+	}
 	if strings.HasPrefix(network, "tcp") {
-		conn, err := Dial(addr, d.server, d.cipher.Copy())
+		conn, err := d.dialForward(ctx, addr)
 		if err != nil {
 			return nil, err
 		}
@@ -55,6 +70,170 @@ func (d *Dialer) Dial(network, addr string) (c net.Conn, err error) {
 	return nil, fmt.Errorf("unsupported connection type: %s", network)
 }
 
+func (d *Dialer) dialForward(ctx context.Context, addr string) (*Conn, error) {
+	ra, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	forward := d.forward
+	if forward == nil {
+		forward = defaultForward
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.server)
+	if err != nil {
+		return nil, err
+	}
+	if d.ws != nil {
+		lift := handshakeDeadline(ctx, conn)
+		ws, err := DialWS(conn, d.server, d.ws)
+		lift()
+		if err != nil {
+			return nil, err
+		}
+		conn = ws
+	}
+	if d.obfs != "" {
+		host := d.obfsHost
+		if host == "" {
+			host, _, _ = net.SplitHostPort(d.server)
+		}
+		conn = NewObfsClientConn(conn, d.obfs, host)
+	}
+	return NewClientConn(conn, ra, d.cipher.Copy())
+}
+
+// SetWebSocket makes the dialer reach the server over the WebSocket
+// transport, see ListenWS.
+func (d *Dialer) SetWebSocket(cfg *WSConfig) {
+	d.ws = cfg
+}
+
+// SetObfs makes the dialer wrap connections to the server in simple-obfs
+// framing, ObfsHTTP or ObfsTLS, pretending to talk to host.
+func (d *Dialer) SetObfs(mode, host string) error {
+	if err := CheckObfsMode(mode); err != nil {
+		return err
+	}
+	d.obfs, d.obfsHost = mode, host
+	return nil
+}
+
+// muxPool holds the sessions streams are opened on.
+type muxPool struct {
+	sync.Mutex
+	maxConns   int
+	maxStreams int
+	sessions   []*MuxSession
+	dialing    int           // sessions being started
+	dialed     chan struct{} // closed when one of them is done
+}
+
+// SetMux makes the dialer open streams on at most maxConns multiplexed
+// connections to the server, starting another one once maxStreams streams
+// are open on each. Servers refuse more than 128 streams per connection.
+// Multiplexing doesn't work with one time auth.
+func (d *Dialer) SetMux(maxConns, maxStreams int) {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	if maxStreams < 1 {
+		maxStreams = 1
+	}
+	d.mux = &muxPool{maxConns: maxConns, maxStreams: maxStreams, dialed: make(chan struct{})}
+}
+
+func (d *Dialer) dialMux(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.cipher.ota {
+		return nil, errors.New("mux: not supported with one time auth")
+	}
+	ra, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.muxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = st.Write(ra); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return &muxConn{MuxStream: st, raddr: &ProxyAddr{network: network, address: addr}}, nil
+}
+
+// muxSession returns the least busy session, starting a new one if all are
+// full and there's room for another. The lock isn't held while dialing, so
+// streams on the other sessions can be opened meanwhile. With no session
+// up yet and the pool filled by pending dials, it waits for one of those.
+func (d *Dialer) muxSession(ctx context.Context) (*MuxSession, error) {
+	p := d.mux
+	p.Lock()
+	for {
+		best := p.leastBusy()
+		full := len(p.sessions)+p.dialing >= p.maxConns
+		if best != nil && (best.NumStreams() < p.maxStreams || full) {
+			p.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		dialed := p.dialed
+		p.Unlock()
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.Lock()
+	}
+	p.dialing++
+	p.Unlock()
+	conn, err := d.dialForward(ctx, MuxAddr)
+	p.Lock()
+	defer p.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	s := NewMuxClient(conn)
+	p.sessions = append(p.sessions, s)
+	return s, nil
+}
+
+// leastBusy drops closed sessions and returns the one with the fewest
+// streams, nil if none is left. The lock must be held.
+func (p *muxPool) leastBusy() *MuxSession {
+	var best *MuxSession
+	live := p.sessions[:0]
+	for _, s := range p.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		live = append(live, s)
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	p.sessions = live
+	return best
+}
+
+type muxConn struct {
+	*MuxStream
+	raddr *ProxyAddr
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
 func (c *ProxyConn) LocalAddr() net.Addr {
 	return c.Conn.LocalAddr()
 }
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	ip6tSoOriginalDst   = 80 // IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR
+)
+
+// GetOriginalDst returns the destination of a connection that was redirected
+// to us by iptables/nftables REDIRECT. The address is encoded the same way as
+// a socks request (starting from ATYP), so it can be passed to
+// DialWithRawAddr directly.
+func GetOriginalDst(c *net.TCPConn) (rawaddr []byte, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	isIPv6 := false
+	if la, ok := c.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+		isIPv6 = true
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		if isIPv6 {
+			// IP6T_SO_ORIGINAL_DST writes a sockaddr_in6, which fits in the
+			// IPv6MTUInfo struct syscall already knows how to fetch.
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				return
+			}
+			port := ntohs(info.Addr.Port)
+			rawaddr = RawAddrFromIP(net.IP(info.Addr.Addr[:]), int(port))
+			return
+		}
+		// SO_ORIGINAL_DST writes a sockaddr_in (16 bytes), the same size as
+		// ip_mreq is assumed to be by GetsockoptIPv6Mreq.
+		var mreq *syscall.IPv6Mreq
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			return
+		}
+		port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+		rawaddr = RawAddrFromIP(net.IP(mreq.Multiaddr[4:8]), int(port))
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	return
+}
+
+// ListenTProxyUDP listens for UDP datagrams diverted by an iptables/nftables
+// TPROXY rule. Use ReadFromTProxy to get the original destination of each
+// datagram.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := listenTransparentUDP(laddr, true)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialTProxyReply opens a socket bound to the (foreign) address from, used
+// to send replies back to a TPROXY'd client so they appear to come from the
+// destination the client originally addressed.
+func DialTProxyReply(from *net.UDPAddr) (*net.UDPConn, error) {
+	return listenTransparentUDP(from, false)
+}
+
+func listenTransparentUDP(laddr *net.UDPAddr, recvOrigDst bool) (*net.UDPConn, error) {
+	family, level, transparent, recvOpt := syscall.AF_INET, syscall.SOL_IP, syscall.IP_TRANSPARENT, syscall.IP_RECVORIGDSTADDR
+	var sa syscall.Sockaddr
+	if ip4 := laddr.IP.To4(); ip4 != nil || laddr.IP == nil {
+		sa4 := &syscall.SockaddrInet4{Port: laddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family, level, transparent, recvOpt = syscall.AF_INET6, syscall.SOL_IPV6, ipv6Transparent, ipv6RecvOrigDstAddr
+		sa6 := &syscall.SockaddrInet6{Port: laddr.Port}
+		copy(sa6.Addr[:], laddr.IP.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	opts := [][3]int{
+		{syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1},
+		{level, transparent, 1},
+	}
+	if recvOrigDst {
+		opts = append(opts, [3]int{level, recvOpt, 1})
+	}
+	for _, o := range opts {
+		if err = syscall.SetsockoptInt(fd, o[0], o[1], o[2]); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "tproxy-udp")
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ReadFromTProxy reads a datagram from a socket created by ListenTProxyUDP,
+// returning the client address and the destination the client sent it to.
+func ReadFromTProxy(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 1024)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVORIGDSTADDR &&
+			len(m.Data) >= syscall.SizeofSockaddrInet4:
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&m.Data[0]))
+			dst = &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: int(ntohs(sa.Port))}
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr &&
+			len(m.Data) >= syscall.SizeofSockaddrInet6:
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&m.Data[0]))
+			dst = &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: int(ntohs(sa.Port))}
+		}
+	}
+	if dst == nil {
+		err = errors.New("shadowsocks: original destination not found, is the TPROXY rule in place?")
+	}
+	return
+}
+
+// ntohs converts a port stored in network byte order in a raw sockaddr.
+func ntohs(p uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&p))
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,161 @@
+//go:build linux
+// +build linux
+
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRedirNetns runs TestRedirHelper in a network namespace of its own,
+// where it can set up REDIRECT and TPROXY rules without touching the host.
+func TestRedirNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	for _, tool := range []string{"ip", "iptables", "ip6tables"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command(exe, "-test.run=^TestRedirHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), "SSGO_REDIR_NETNS=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if _, ran := err.(*exec.ExitError); !ran {
+			t.Skipf("can't create a network namespace: %v", err)
+		}
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("--- PASS: TestRedirHelper")) {
+		t.Fatalf("helper didn't run:\n%s", out)
+	}
+}
+
+func TestRedirHelper(t *testing.T) {
+	if os.Getenv("SSGO_REDIR_NETNS") != "1" {
+		return
+	}
+	sh(t, "ip", "link", "set", "lo", "up")
+	// Routes for the documentation ranges standing in for remote hosts,
+	// and policy routing of the marked udp datagrams back in through lo,
+	// where TPROXY can take them.
+	sh(t, "ip", "route", "add", "198.51.100.0/24", "dev", "lo")
+	sh(t, "ip", "-6", "route", "add", "2001:db8::/64", "dev", "lo")
+	for _, v := range []string{"-4", "-6"} {
+		sh(t, "ip", v, "rule", "add", "fwmark", "1", "lookup", "100")
+	}
+	sh(t, "ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100")
+	sh(t, "ip", "-6", "route", "add", "local", "::/0", "dev", "lo", "table", "100")
+
+	for _, c := range []struct {
+		iptables, loopback, target string
+	}{
+		{"iptables", "127.0.0.1", "198.51.100.1"},
+		{"ip6tables", "::1", "2001:db8::1"},
+	} {
+		t.Run(c.iptables+" redirect", func(t *testing.T) {
+			testRedirect(t, c.iptables, c.loopback, c.target)
+		})
+		t.Run(c.iptables+" tproxy", func(t *testing.T) {
+			testTProxy(t, c.iptables, c.loopback, c.target)
+		})
+	}
+}
+
+func sh(t *testing.T, name string, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %v: %v\n%s", name, args, err, out)
+	}
+}
+
+// testRedirect checks that GetOriginalDst recovers target:80 from a
+// connection redirected to a listener on loopback.
+func testRedirect(t *testing.T, iptables, loopback, target string) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(loopback, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	sh(t, iptables, "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", target, "--dport", "80", "-j", "REDIRECT", "--to-ports", port)
+
+	go func() {
+		if c, err := net.DialTimeout("tcp", net.JoinHostPort(target, "80"), 5*time.Second); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	raw, err := GetOriginalDst(c.(*net.TCPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := RawAddrFromIP(net.ParseIP(target), 80); !bytes.Equal(raw, expect) {
+		t.Errorf("original destination %v, want %v", raw, expect)
+	}
+}
+
+// testTProxy checks that a datagram to target:53 diverted by TPROXY is read
+// with its original destination, and that a reply sent from there reaches
+// the client.
+func testTProxy(t *testing.T, iptables, loopback, target string) {
+	ln, err := ListenTProxyUDP(net.JoinHostPort(loopback, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.LocalAddr().(*net.UDPAddr).Port)
+	sh(t, iptables, "-t", "mangle", "-A", "OUTPUT", "-p", "udp", "-d", target, "--dport", "53", "-j", "MARK", "--set-mark", "1")
+	sh(t, iptables, "-t", "mangle", "-A", "PREROUTING", "-i", "lo", "-p", "udp", "-d", target, "--dport", "53",
+		"-j", "TPROXY", "--on-ip", loopback, "--on-port", port, "--tproxy-mark", "1")
+
+	client, err := net.Dial("udp", net.JoinHostPort(target, "53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, src, dst, err := ReadFromTProxy(ln, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || !dst.IP.Equal(net.ParseIP(target)) || dst.Port != 53 {
+		t.Fatalf("read %q to %v, want ping to %s:53", buf[:n], dst, target)
+	}
+	reply, err := DialTProxyReply(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+	if _, err = reply.WriteToUDP([]byte("pong"), src); err != nil {
+		t.Fatal(err)
+	}
+	// The client's socket is connected, so only a reply from target gets in.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err = client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("client got %q, %v; want pong", buf[:n], err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"errors"
+	"net"
+)
+
+var errRedirUnsupported = errors.New("shadowsocks: transparent proxy is only supported on linux")
+
+func GetOriginalDst(c *net.TCPConn) (rawaddr []byte, err error) {
+	return nil, errRedirUnsupported
+}
+
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, errRedirUnsupported
+}
+
+func DialTProxyReply(from *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errRedirUnsupported
+}
+
+func ReadFromTProxy(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	err = errRedirUnsupported
+	return
+}
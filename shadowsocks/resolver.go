@@ -0,0 +1,467 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// systemTTL is how long answers from the system resolver are cached,
+	// as it doesn't tell us the real TTL.
+	systemTTL = 60 * time.Second
+	// negativeTTL is how long "no such host" answers are cached.
+	negativeTTL = 30 * time.Second
+	maxTTL      = 24 * time.Hour
+	maxCacheLen = 10000
+)
+
+// ResolverConfig configures a Resolver. The zero value resolves with the
+// system resolver and caches the answers.
+type ResolverConfig struct {
+	// Upstreams are tried in order until one answers:
+	//	udp://1.1.1.1:53 (or just 1.1.1.1)
+	//	tcp://1.1.1.1:53
+	//	tls://1.1.1.1:853                       (DNS over TLS)
+	//	https://cloudflare-dns.com/dns-query    (DNS over HTTPS)
+	Upstreams []string
+	// Prefer orders the answers: "ipv4" or "ipv6" put that family first,
+	// "ipv4_only" and "ipv6_only" don't ask for the other family at all.
+	// Unset is "ipv6", the default of rfc8305.
+	Prefer string
+	// Hosts maps names to fixed addresses, like /etc/hosts.
+	Hosts   map[string][]string
+	Timeout time.Duration
+}
+
+// Resolver looks up the addresses of outbound targets, caching answers as
+// long as their TTL allows.
+type Resolver struct {
+	upstreams []dnsUpstream
+	prefer    string
+	hosts     map[string][]net.IP
+	timeout   time.Duration
+	now       func() time.Time // replaced by tests
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// dnsUpstream exchanges one wire format DNS message with a server.
+type dnsUpstream interface {
+	exchange(ctx context.Context, msg []byte) ([]byte, error)
+	String() string
+}
+
+// ErrNoSuchHost is returned for names that don't exist or have no address.
+var ErrNoSuchHost = errors.New("no such host")
+
+// NewResolver creates a resolver from rc.
+func NewResolver(rc ResolverConfig) (*Resolver, error) {
+	r := &Resolver{
+		prefer:  rc.Prefer,
+		hosts:   make(map[string][]net.IP, len(rc.Hosts)),
+		timeout: rc.Timeout,
+		now:     time.Now,
+		cache:   make(map[string]cacheEntry),
+	}
+	switch rc.Prefer {
+	case "", "ipv4", "ipv6", "ipv4_only", "ipv6_only":
+	default:
+		return nil, fmt.Errorf("dns_prefer: unknown value %q", rc.Prefer)
+	}
+	if r.timeout == 0 {
+		r.timeout = 5 * time.Second
+	}
+	for name, addrs := range rc.Hosts {
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("dns_hosts: invalid address %q for %s", a, name)
+			}
+			r.hosts[normalizeDomain(name)] = append(r.hosts[normalizeDomain(name)], ip)
+		}
+	}
+	for _, u := range rc.Upstreams {
+		up, err := newDNSUpstream(u, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, up)
+	}
+	return r, nil
+}
+
+func newDNSUpstream(s string, timeout time.Duration) (dnsUpstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("dns upstream %s: %v", s, err)
+	}
+	withPort := func(port string) string {
+		if u.Port() != "" {
+			return u.Host
+		}
+		return net.JoinHostPort(strings.Trim(u.Host, "[]"), port)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &dnsStream{network: u.Scheme, addr: withPort("53")}, nil
+	case "tls":
+		return &dnsStream{network: "tls", addr: withPort("853"), serverName: u.Hostname()}, nil
+	case "https":
+		return &dnsHTTPS{url: u.String(), client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("dns upstream %s: unsupported scheme %q", s, u.Scheme)
+}
+
+// LookupIP returns the addresses of host, ordered by the preferred family.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = normalizeDomain(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips, ok := r.hosts[host]; ok {
+		return r.order(ips), nil
+	}
+	if e, ok := r.cached(host); ok {
+		return e.ips, e.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var e cacheEntry
+	if len(r.upstreams) == 0 {
+		e = r.lookupSystem(ctx, host)
+	} else {
+		e = r.lookupUpstreams(ctx, host)
+	}
+	if e.err != nil && e.err != ErrNoSuchHost {
+		// Server failures and timeouts are not cached.
+		return nil, e.err
+	}
+	e.ips = r.order(e.ips)
+	r.store(host, e)
+	return e.ips, e.err
+}
+
+func (r *Resolver) cached(host string) (cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[host]
+	if !ok {
+		return e, false
+	}
+	if !r.now().Before(e.expires) {
+		delete(r.cache, host)
+		return e, false
+	}
+	return e, true
+}
+
+func (r *Resolver) store(host string, e cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= maxCacheLen {
+		now := r.now()
+		for k, v := range r.cache {
+			if !now.Before(v.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// Still full of live entries, drop some at random (map order).
+		for k := range r.cache {
+			if len(r.cache) < maxCacheLen*9/10 {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[host] = e
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, host string) cacheEntry {
+	network := "ip"
+	switch r.prefer {
+	case "ipv4_only":
+		network = "ip4"
+	case "ipv6_only":
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return cacheEntry{err: ErrNoSuchHost, expires: r.now().Add(negativeTTL)}
+		}
+		return cacheEntry{err: err}
+	}
+	return cacheEntry{ips: ips, expires: r.now().Add(systemTTL)}
+}
+
+func (r *Resolver) lookupUpstreams(ctx context.Context, host string) (e cacheEntry) {
+	var qtypes []dnsmessage.Type
+	if r.prefer != "ipv6_only" {
+		qtypes = append(qtypes, dnsmessage.TypeA)
+	}
+	if r.prefer != "ipv4_only" {
+		qtypes = append(qtypes, dnsmessage.TypeAAAA)
+	}
+	for _, up := range r.upstreams {
+		if e = r.lookupUpstream(ctx, up, host, qtypes); e.err == nil || e.err == ErrNoSuchHost {
+			return
+		}
+		Debug.Printf("dns: %s failed for %s: %v\n", up, host, e.err)
+	}
+	return
+}
+
+// lookupUpstream asks up for every qtype of host in parallel.
+func (r *Resolver) lookupUpstream(ctx context.Context, up dnsUpstream, host string, qtypes []dnsmessage.Type) cacheEntry {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan answer, len(qtypes))
+	for _, qt := range qtypes {
+		go func(qt dnsmessage.Type) {
+			ips, ttl, err := query(ctx, up, host, qt)
+			results <- answer{ips, ttl, err}
+		}(qt)
+	}
+	var e cacheEntry
+	ttl := maxTTL
+	var errs []error
+	for range qtypes {
+		a := <-results
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		e.ips = append(e.ips, a.ips...)
+		if len(a.ips) > 0 && a.ttl < ttl {
+			ttl = a.ttl
+		}
+	}
+	if len(errs) == len(qtypes) {
+		e.err = errs[0]
+		return e
+	}
+	if len(e.ips) == 0 {
+		e.err = ErrNoSuchHost
+		ttl = negativeTTL
+	}
+	e.expires = r.now().Add(ttl)
+	return e
+}
+
+func query(ctx context.Context, up dnsUpstream, host string, qt dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// A random id (and the random source port of each exchange) makes
+	// forged udp answers hard to get accepted.
+	var idb [2]byte
+	if _, err = io.ReadFull(rand.Reader, idb[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qt, Class: dnsmessage.ClassINET}},
+	}
+	msg, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := up.exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	if m.ID != id {
+		return nil, 0, errors.New("dns: response id mismatch")
+	}
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL, nil
+	default:
+		return nil, 0, fmt.Errorf("dns: %s answered %v", up, m.RCode)
+	}
+	var ips []net.IP
+	ttl := maxTTL
+	for _, a := range m.Answers {
+		if a.Header.Class != dnsmessage.ClassINET {
+			continue
+		}
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]))
+		default:
+			continue // CNAMEs are followed by the server
+		}
+		if t := time.Duration(a.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if len(ips) == 0 {
+		ttl = negativeTTL
+	}
+	return ips, ttl, nil
+}
+
+// order sorts ips by the preferred family, keeping the order within each.
+func (r *Resolver) order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch r.prefer {
+	case "ipv4":
+		return append(v4, v6...)
+	case "", "ipv6":
+		return append(v6, v4...)
+	case "ipv4_only":
+		return v4
+	default: // ipv6_only
+		return v6
+	}
+}
+
+// dnsStream talks to a server over udp, tcp or tls.
+type dnsStream struct {
+	network    string
+	addr       string
+	serverName string
+}
+
+func (s *dnsStream) String() string {
+	return s.network + "://" + s.addr
+}
+
+func (s *dnsStream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	resp, err := s.exchangeOn(ctx, s.network, msg)
+	if err == nil && s.network == "udp" && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// TC bit set, the answer didn't fit in a datagram.
+		return s.exchangeOn(ctx, "tcp", msg)
+	}
+	return resp, err
+}
+
+func (s *dnsStream) exchangeOn(ctx context.Context, network string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	var c net.Conn
+	var err error
+	if network == "tls" {
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: s.serverName}}
+		c, err = td.DialContext(ctx, "tcp", s.addr)
+	} else {
+		c, err = d.DialContext(ctx, network, s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err = c.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	// tcp and tls prefix messages with their length.
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err = c.Write(framed); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err = io.ReadFull(c, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(c, resp)
+	return resp, err
+}
+
+// dnsHTTPS is a DNS over HTTPS (rfc8484) server.
+type dnsHTTPS struct {
+	url    string
+	client *http.Client
+}
+
+func (h *dnsHTTPS) String() string {
+	return h.url
+}
+
+func (h *dnsHTTPS) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	// rfc8484 recommends id 0 for better caching; query checks the id, so
+	// the answer gets the original one back.
+	id := binary.BigEndian.Uint16(msg)
+	msg = append([]byte(nil), msg...)
+	msg[0], msg[1] = 0, 0
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: %s: %s", h.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 2 {
+		return nil, errors.New("dns: short response")
+	}
+	binary.BigEndian.PutUint16(body, id)
+	return body, nil
+}
@@ -0,0 +1,186 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers A and AAAA queries from a fixed table over udp.
+type stubDNS struct {
+	conn    net.PacketConn
+	records map[string][]net.IP // name with trailing dot
+	ttl     uint32
+
+	mu      sync.Mutex
+	queries int
+}
+
+func newStubDNS(t *testing.T, records map[string][]net.IP) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubDNS{conn: conn, records: records, ttl: 60}
+	go s.serve()
+	return s
+}
+
+func (s *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(buf[:n]); err != nil || len(q.Questions) != 1 {
+			continue
+		}
+		s.mu.Lock()
+		s.queries++
+		s.mu.Unlock()
+		question := q.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true},
+			Questions: q.Questions,
+		}
+		ips, ok := s.records[question.Name.String()]
+		if !ok {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		for _, ip := range ips {
+			h := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+			if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+				h.Type = dnsmessage.TypeA
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &a})
+			} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+				h.Type = dnsmessage.TypeAAAA
+				var a dnsmessage.AAAAResource
+				copy(a.AAAA[:], ip)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &a})
+			}
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(b, addr)
+	}
+}
+
+func (s *stubDNS) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func TestResolverCache(t *testing.T) {
+	stub := newStubDNS(t, map[string][]net.IP{
+		"dual.example.": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+	})
+	defer stub.conn.Close()
+	r, err := NewResolver(ResolverConfig{
+		Upstreams: []string{stub.conn.LocalAddr().String()},
+		Prefer:    "ipv4",
+		Hosts:     map[string][]string{"Fixed.Example": {"198.51.100.7"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ips, err := r.LookupIP(context.Background(), "dual.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got %v, want ipv4 address first", ips)
+	}
+	if n := stub.count(); n != 2 {
+		t.Errorf("%d queries, want A and AAAA", n)
+	}
+
+	if _, err = r.LookupIP(context.Background(), "dual.example"); err != nil {
+		t.Fatal(err)
+	}
+	if n := stub.count(); n != 2 {
+		t.Errorf("%d queries, want the second lookup served from cache", n)
+	}
+
+	now = now.Add(61 * time.Second)
+	if _, err = r.LookupIP(context.Background(), "dual.example"); err != nil {
+		t.Fatal(err)
+	}
+	if n := stub.count(); n != 4 {
+		t.Errorf("%d queries, want the expired entry looked up again", n)
+	}
+
+	if _, err = r.LookupIP(context.Background(), "missing.example"); err != ErrNoSuchHost {
+		t.Errorf("missing.example: got %v, want ErrNoSuchHost", err)
+	}
+	before := stub.count()
+	r.LookupIP(context.Background(), "missing.example")
+	if stub.count() != before {
+		t.Error("negative answer was not cached")
+	}
+
+	ips, err = r.LookupIP(context.Background(), "fixed.example.")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("hosts override: got %v, %v", ips, err)
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	stub := newStubDNS(t, map[string][]net.IP{"v4.example.": {net.ParseIP("192.0.2.9")}})
+	defer stub.conn.Close()
+	// Nothing listens on the first upstream, so the lookup falls back to
+	// the stub.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+	r, err := NewResolver(ResolverConfig{
+		Upstreams: []string{"udp://" + deadAddr, "udp://" + stub.conn.LocalAddr().String()},
+		Prefer:    "ipv4_only",
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := r.LookupIP(context.Background(), "v4.example")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.9")) {
+		t.Errorf("got %v, %v", ips, err)
+	}
+	if n := stub.count(); n != 1 {
+		t.Errorf("%d queries, want only A with ipv4_only", n)
+	}
+}
+
+func TestResolverPreferDefault(t *testing.T) {
+	r, err := NewResolver(ResolverConfig{
+		Hosts: map[string][]string{"dual.example": {"192.0.2.1", "2001:db8::1", "192.0.2.2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := r.LookupIP(context.Background(), "dual.example")
+	want := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}
+	if err != nil || len(ips) != len(want) {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+	for i := range want {
+		if ips[i].String() != want[i] {
+			t.Fatalf("got %v, want ipv6 address first", ips)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Target is a destination checked against a RuleSet. Domain is empty when
+// the user asked for an ip address, IP is nil when the domain has not been
+// resolved (rules on ip ranges then never match).
+type Target struct {
+	Domain string
+	IP     net.IP
+	Port   int
+}
+
+// Rule is one line of an acl file. All conditions that are set must match.
+type Rule struct {
+	full   string         // exact domain
+	suffix string         // domain and its subdomains
+	re     *regexp.Regexp // matched against the domain
+	ipnet  *net.IPNet
+	portLo int
+	portHi int // 0 means any port
+}
+
+// Match reports whether t satisfies every condition of the rule.
+func (r *Rule) Match(t Target) bool {
+	if r.full != "" && t.Domain != r.full {
+		return false
+	}
+	if r.suffix != "" && t.Domain != r.suffix && !strings.HasSuffix(t.Domain, "."+r.suffix) {
+		return false
+	}
+	if r.re != nil && (t.Domain == "" || !r.re.MatchString(t.Domain)) {
+		return false
+	}
+	if r.ipnet != nil {
+		ip := t.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if ip == nil || !r.ipnet.Contains(ip) {
+			return false
+		}
+	}
+	if r.portHi != 0 && (t.Port < r.portLo || t.Port > r.portHi) {
+		return false
+	}
+	return true
+}
+
+// RuleSet is a destination filter loaded from a file compatible with the
+// shadowsocks-libev acl format:
+//
+//	[accept_all]            # or [reject_all]: the default action
+//	[black_list]            # targets matching these lines are denied
+//	(^|\.)tracker\.example\.com$
+//	[white_list]            # targets matching these lines are allowed
+//	203.0.113.0/24
+//	[outbound_block_list]   # always denied, even if white listed
+//	port:25
+//
+// Besides libev's ip/cidr and regular expression lines, a line may use
+// full:example.com (exact domain), domain:example.com (domain and its
+// subdomains), regexp:..., and port:25 or port:6881-6889. Several conditions
+// separated by spaces on one line must all match, e.g.
+// "domain:example.com port:25".
+//
+// A [route:name] section lists allowed targets that should be reached
+// through the upstream proxy called name instead of the default route;
+// [route:direct] connects directly. The first matching route wins.
+type RuleSet struct {
+	defaultDeny bool
+	block       []*Rule
+	white       []*Rule
+	black       []*Rule
+	routes      []route
+}
+
+// RouteDirect is the route name for connecting without an upstream proxy.
+const RouteDirect = "direct"
+
+type route struct {
+	name string
+	rule *Rule
+}
+
+// LoadRuleSet reads an acl file.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := ParseRuleSet(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rs, nil
+}
+
+// ParseRuleSet reads an acl from r.
+func ParseRuleSet(r io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{}
+	list := &rs.black // libev treats lines before any section as black list
+	routeName := ""
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			routeName = ""
+			if strings.HasPrefix(line, "[route:") {
+				routeName = strings.TrimSpace(line[len("[route:") : len(line)-1])
+				if routeName == "" {
+					return nil, fmt.Errorf("line %d: empty route name", lineno)
+				}
+				list = nil
+				continue
+			}
+			switch line {
+			case "[accept_all]", "[proxy_all]":
+				rs.defaultDeny = false
+			case "[reject_all]", "[bypass_all]":
+				rs.defaultDeny = true
+			case "[black_list]", "[bypass_list]":
+				list = &rs.black
+			case "[white_list]", "[proxy_list]":
+				list = &rs.white
+			case "[outbound_block_list]":
+				list = &rs.block
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", lineno, line)
+			}
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if list == nil {
+			rs.routes = append(rs.routes, route{routeName, rule})
+		} else {
+			*list = append(*list, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseRule(line string) (*Rule, error) {
+	r := &Rule{}
+	for _, tok := range strings.Fields(line) {
+		var err error
+		switch {
+		case strings.HasPrefix(tok, "full:"):
+			r.full = normalizeDomain(tok[len("full:"):])
+		case strings.HasPrefix(tok, "domain:"):
+			r.suffix = normalizeDomain(tok[len("domain:"):])
+		case strings.HasPrefix(tok, "regexp:"):
+			r.re, err = regexp.Compile(tok[len("regexp:"):])
+		case strings.HasPrefix(tok, "port:"):
+			r.portLo, r.portHi, err = parsePortRange(tok[len("port:"):])
+		default:
+			if n, cerr := ParseCIDR(tok); cerr == nil {
+				r.ipnet = n
+			} else {
+				r.re, err = regexp.Compile(tok)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (lo, hi int, err error) {
+	loStr, hiStr := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		loStr, hiStr = s[:i], s[i+1:]
+	}
+	if lo, err = strconv.Atoi(loStr); err == nil {
+		hi, err = strconv.Atoi(hiStr)
+	}
+	if err != nil || lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
+
+// NewTarget builds a Target from a host:port string as requested by a user.
+// ip is the address the host resolved to, or nil.
+func NewTarget(host string, ip net.IP) (t Target, err error) {
+	name, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return
+	}
+	if t.Port, err = strconv.Atoi(portStr); err != nil {
+		return
+	}
+	if literal := net.ParseIP(name); literal != nil {
+		t.IP = literal
+	} else {
+		t.Domain = normalizeDomain(name)
+		t.IP = ip
+	}
+	return
+}
+
+// Allowed reports whether t may be connected to. A nil RuleSet allows
+// everything.
+func (rs *RuleSet) Allowed(t Target) bool {
+	if rs == nil {
+		return true
+	}
+	if matchAny(rs.block, t) {
+		return false
+	}
+	if matchAny(rs.white, t) {
+		return true
+	}
+	if matchAny(rs.black, t) {
+		return false
+	}
+	return !rs.defaultDeny
+}
+
+// Blocked reports whether t matches the outbound_block_list. A nil RuleSet
+// blocks nothing.
+func (rs *RuleSet) Blocked(t Target) bool {
+	return rs != nil && matchAny(rs.block, t)
+}
+
+// Route returns the name of the upstream t should be reached through, if a
+// route rule matches it. A nil RuleSet has no routes.
+func (rs *RuleSet) Route(t Target) (name string, ok bool) {
+	if rs == nil {
+		return "", false
+	}
+	for _, r := range rs.routes {
+		if r.rule.Match(t) {
+			return r.name, true
+		}
+	}
+	return "", false
+}
+
+// RouteNames lists the upstream names used by route sections.
+func (rs *RuleSet) RouteNames() (names []string) {
+	if rs == nil {
+		return nil
+	}
+	for _, r := range rs.routes {
+		names = append(names, r.name)
+	}
+	return
+}
+
+func matchAny(rules []*Rule, t Target) bool {
+	for _, r := range rules {
+		if r.Match(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testACL = `
+# hosting provider terms
+[accept_all]
+
+[black_list]
+(^|\.)tracker\.example\.org$
+full:blocked.example.com
+domain:ads.example.net
+10.0.0.0/8
+port:6881-6889
+
+[white_list]
+10.1.2.3
+
+[outbound_block_list]
+port:25
+`
+
+func TestRuleSet(t *testing.T) {
+	rs, err := ParseRuleSet(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{"example.com:443", "93.184.216.34", true},
+		{"tracker.example.org:80", "", false},
+		{"open.tracker.example.org:80", "", false},
+		{"nottracker.example.org:80", "", true},
+		{"blocked.example.com:443", "", false},
+		{"www.blocked.example.com:443", "", true},
+		{"ads.example.net:443", "", false},
+		{"x.ads.example.net:443", "", false},
+		{"badads.example.net:443", "", true},
+		{"10.9.9.9:80", "", false},
+		{"intranet.example.com:80", "10.9.9.9", false},
+		{"10.1.2.3:80", "", true},
+		{"10.1.2.3:25", "", false},
+		{"mail.example.com:25", "93.184.216.34", false},
+		{"peer.example.com:6885", "", false},
+		{"peer.example.com:6890", "", true},
+	}
+	for _, tt := range tests {
+		target, err := NewTarget(tt.host, net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(tt.host, err)
+		}
+		if got := rs.Allowed(target); got != tt.allowed {
+			t.Errorf("%s (%s): allowed=%v, want %v", tt.host, tt.ip, got, tt.allowed)
+		}
+		// Only port 25 is in the outbound_block_list.
+		if got := rs.Blocked(target); got != (target.Port == 25) {
+			t.Errorf("%s (%s): blocked=%v", tt.host, tt.ip, got)
+		}
+	}
+	var none *RuleSet
+	if target, _ := NewTarget("mail.example.com:25", nil); none.Blocked(target) {
+		t.Error("nil rule set blocks")
+	}
+}
+
+func TestRuleSetRejectAll(t *testing.T) {
+	rs, err := ParseRuleSet(strings.NewReader("[reject_all]\n[white_list]\ndomain:example.com port:443\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, allowed := range map[string]bool{
+		"example.com:443":     true,
+		"www.example.com:443": true,
+		"example.com:80":      false,
+		"example.org:443":     false,
+	} {
+		target, _ := NewTarget(host, nil)
+		if got := rs.Allowed(target); got != allowed {
+			t.Errorf("%s: allowed=%v, want %v", host, got, allowed)
+		}
+	}
+}
+
+func TestRuleSetErrors(t *testing.T) {
+	for _, acl := range []string{
+		"[no_such_section]\n",
+		"port:0\n",
+		"port:90-80\n",
+		"regexp:(\n",
+	} {
+		if _, err := ParseRuleSet(strings.NewReader(acl)); err == nil {
+			t.Errorf("%q: expected error", acl)
+		}
+	}
+}
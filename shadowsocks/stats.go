@@ -1,64 +1,166 @@
 package shadowsocks
 
 import (
-    "sync"
-    "time"
-    "fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var Stats map[string]*PortStats
+// Stats holds the traffic of the ports served.
+var Stats = NewStatsRegistry()
 
+// StatsRegistry keeps the traffic counters of ports until they are flushed.
+// It is safe for concurrent use; counting doesn't take its lock.
+type StatsRegistry struct {
+	mu    sync.RWMutex
+	ports map[string]*PortStats
+}
+
+// PortStats is the traffic of a port not flushed yet, in counters updated
+// atomically. u and d are the payload bytes, ue and de what the wire
+// carried beyond them. Bytes on the wire are added to ue and de as a
+// WireConn sees them and the payload taken off as it is relayed, so ue and
+// de can briefly go negative.
 type PortStats struct {
-    sync.Mutex
-    D int64
-    U int64
-    De int64
-    Ue int64
-    T int64
-}
-
-
-
-func InitStats() {
-    Stats = make(map[string]*PortStats)
-}
-
-func updateU(port string,u int) {
-    stat, ok := Stats[port]
-    if !ok {
-        panic(fmt.Errorf("Port: %s 's stat doesn't exist!",port))
-    }
-    stat.Lock()
-    defer stat.Unlock()
-    if (u>0) {
-        stat.U += int64(u)
-        stat.Ue += 534
-        stat.T = time.Now().Unix()
-    }
-}
-
-func updateD(port string,d int) {
-    stat, ok := Stats[port]
-    if !ok {
-        panic(fmt.Errorf("Port: %s 's stat doesn't exist!",port))
-    }
-    stat.Lock()
-    defer stat.Unlock()
-    if (d>0) {
-        stat.D += int64(d)
-        stat.De += 534
-        stat.T = time.Now().Unix()
-    }
-}
-
-func AddStat(port string) {
-    var mutex sync.Mutex    
-    mutex.Lock()
-    defer mutex.Unlock()
-    _, ok := Stats[port]
-    if !ok {
-        Debug.Printf("updateStat port:%s record not found! Add!",port)
-        Stats[port] = &PortStats{U:0,D:0,T:0}
-        Debug.Printf("addStat: port:%s",port)
-    }
-}
\ No newline at end of file
+	u, d, ue, de int64
+	t            int64 // last activity, unix seconds
+	removed      int32 // dropped from the registry at the next flush
+}
+
+// Traffic is a snapshot of the counters of a port, with the overhead
+// never negative.
+type Traffic struct {
+	U, D, Ue, De int64
+	T            int64
+}
+
+// NewStatsRegistry returns an empty registry.
+func NewStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{ports: make(map[string]*PortStats)}
+}
+
+// Add starts counting traffic of port, keeping what was counted if it
+// already is.
+func (r *StatsRegistry) Add(port string) *PortStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.ports[port]
+	if !ok {
+		s = &PortStats{}
+		r.ports[port] = s
+		Debug.Printf("addStat: port:%s", port)
+	}
+	atomic.StoreInt32(&s.removed, 0)
+	return s
+}
+
+// Get returns the counters of port, nil if it isn't counted.
+func (r *StatsRegistry) Get(port string) *PortStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ports[port]
+}
+
+// Remove stops counting traffic of port once what was counted is flushed.
+func (r *StatsRegistry) Remove(port string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.ports[port]; ok {
+		atomic.StoreInt32(&s.removed, 1)
+	}
+}
+
+// Snapshot returns the traffic of every port, leaving the counters alone.
+func (r *StatsRegistry) Snapshot() map[string]Traffic {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := make(map[string]Traffic, len(r.ports))
+	for port, s := range r.ports {
+		m[port] = s.traffic()
+	}
+	return m
+}
+
+// Flush takes the traffic of the ports with any counted since the last
+// flush, taking it off their counters, and forgets removed ports.
+func (r *StatsRegistry) Flush() map[string]Traffic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]Traffic)
+	for port, s := range r.ports {
+		if t := s.traffic(); t.U != 0 || t.D != 0 || t.Ue != 0 || t.De != 0 {
+			// Taking off what was read keeps what's counted meanwhile.
+			atomic.AddInt64(&s.u, -t.U)
+			atomic.AddInt64(&s.d, -t.D)
+			atomic.AddInt64(&s.ue, -t.Ue)
+			atomic.AddInt64(&s.de, -t.De)
+			m[port] = t
+		}
+		if atomic.LoadInt32(&s.removed) == 1 {
+			delete(r.ports, port)
+		}
+	}
+	return m
+}
+
+func (s *PortStats) traffic() Traffic {
+	t := Traffic{
+		U:  atomic.LoadInt64(&s.u),
+		D:  atomic.LoadInt64(&s.d),
+		Ue: atomic.LoadInt64(&s.ue),
+		De: atomic.LoadInt64(&s.de),
+		T:  atomic.LoadInt64(&s.t),
+	}
+	if t.Ue < 0 {
+		t.Ue = 0
+	}
+	if t.De < 0 {
+		t.De = 0
+	}
+	return t
+}
+
+// add counts u bytes uploaded and d downloaded. A nil PortStats, of a port
+// not counted, ignores them.
+func (s *PortStats) add(u, d int64) {
+	if s == nil || u <= 0 && d <= 0 {
+		return
+	}
+	if u > 0 {
+		atomic.AddInt64(&s.u, u)
+		atomic.AddInt64(&s.ue, -u)
+	}
+	if d > 0 {
+		atomic.AddInt64(&s.d, d)
+		atomic.AddInt64(&s.de, -d)
+	}
+	atomic.StoreInt64(&s.t, time.Now().Unix())
+}
+
+// addWire counts rx bytes received and tx sent on the wire.
+func (s *PortStats) addWire(rx, tx int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.ue, rx)
+	atomic.AddInt64(&s.de, tx)
+}
+
+func updateU(port string, u int) {
+	Stats.Get(port).add(int64(u), 0)
+}
+
+func updateD(port string, d int) {
+	Stats.Get(port).add(0, int64(d))
+}
+
+func addWire(port string, rx, tx int64) {
+	Stats.Get(port).addWire(rx, tx)
+}
+
+// AddTraffic counts u bytes uploaded and d bytes downloaded by the user of
+// port, for traffic that doesn't pass through the pipe functions. Its wire
+// traffic is counted separately, by AddPacketWire for datagrams.
+func AddTraffic(port string, u, d int) {
+	Stats.Get(port).add(int64(u), int64(d))
+}
@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStatsRegistry(t *testing.T) {
+	r := NewStatsRegistry()
+	s := r.Add("1000")
+	s.addWire(1100, 0)
+	s.add(1000, 0)
+	r.Add("1001")
+
+	m := r.Flush()
+	if len(m) != 1 || m["1000"].U != 1000 || m["1000"].Ue != 100 {
+		t.Fatalf("flushed %+v, want 1000 bytes with 100 overhead of port 1000 only", m)
+	}
+	if m = r.Flush(); len(m) != 0 {
+		t.Errorf("flushed %+v again", m)
+	}
+
+	// A negative overhead is carried over rather than billed.
+	s.add(50, 0)
+	if m = r.Flush(); m["1000"].Ue != 0 {
+		t.Errorf("billed overhead %d ahead of the wire", m["1000"].Ue)
+	}
+	s.addWire(80, 0)
+	s.add(10, 0)
+	if m = r.Flush(); m["1000"].U != 10 || m["1000"].Ue != 20 {
+		t.Errorf("flushed %+v, want 10 bytes with 20 overhead", m["1000"])
+	}
+
+	// Removed ports are flushed once more, then forgotten.
+	s.add(0, 5)
+	r.Remove("1000")
+	if m = r.Flush(); m["1000"].D != 5 {
+		t.Errorf("lost traffic of a removed port: %+v", m)
+	}
+	if r.Get("1000") != nil || r.Get("1001") == nil {
+		t.Error("removed the wrong ports")
+	}
+	// So is what's left of their overhead, like the closing packets.
+	r.Get("1001").addWire(30, 40)
+	r.Remove("1001")
+	if m = r.Flush(); m["1001"].Ue != 30 || m["1001"].De != 40 {
+		t.Errorf("lost overhead of a removed port: %+v", m)
+	}
+	if r.Get("1001") != nil {
+		t.Error("removed port kept")
+	}
+	// Unknown ports are ignored.
+	updateU("1000", 1)
+	AddTraffic("9", 1, 1)
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	r := NewStatsRegistry()
+	var wg sync.WaitGroup
+	var total int64
+	var mu sync.Mutex
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				r.Add("1").add(1, 1)
+				if j%100 == 0 {
+					for _, tr := range r.Flush() {
+						mu.Lock()
+						total += tr.U
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	total += r.Flush()["1"].U
+	if total != 4000 {
+		t.Errorf("flushed %d bytes in all, want 4000", total)
+	}
+}
@@ -0,0 +1,66 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errShortPacket = errors.New("shadowsocks: packet too short")
+
+// EncryptPacket seals one UDP relay datagram. Every datagram carries its own
+// IV, so cipher is copied and never modified.
+//
+// payload should start with the target address encoded as in RawAddr.
+func EncryptPacket(cipher *Cipher, payload []byte) (pkt []byte, err error) {
+	c := cipher.Copy()
+	c.iv = nil
+	iv, err := c.initEncrypt()
+	if err != nil {
+		return
+	}
+	pkt = make([]byte, len(iv)+len(payload))
+	copy(pkt, iv)
+	c.encrypt(pkt[len(iv):], payload)
+	return
+}
+
+// DecryptPacket opens a datagram sealed by EncryptPacket, returning the
+// plaintext (address followed by data).
+func DecryptPacket(cipher *Cipher, pkt []byte) (payload []byte, err error) {
+	ivLen := cipher.info.ivLen
+	if len(pkt) <= ivLen {
+		return nil, errShortPacket
+	}
+	c := cipher.Copy()
+	if err = c.initDecrypt(pkt[:ivLen]); err != nil {
+		return
+	}
+	payload = make([]byte, len(pkt)-ivLen)
+	c.decrypt(payload, pkt[ivLen:])
+	return
+}
+
+// SplitRawAddr splits b into the leading raw address and what follows.
+func SplitRawAddr(b []byte) (addr, data []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, errShortPacket
+	}
+	var l int
+	switch b[0] & AddrMask {
+	case 1:
+		l = 1 + 4 + 2
+	case 4:
+		l = 1 + 16 + 2
+	case 3:
+		if len(b) < 2 {
+			return nil, nil, errShortPacket
+		}
+		l = 1 + 1 + int(b[1]) + 2
+	default:
+		return nil, nil, fmt.Errorf("shadowsocks: addr type %d not supported", b[0]&AddrMask)
+	}
+	if len(b) < l {
+		return nil, nil, errShortPacket
+	}
+	return b[:l], b[l:], nil
+}
@@ -0,0 +1,63 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, method := range []string{"aes-128-cfb", "salsa20", "rc4-md5"} {
+		cipher, err := NewCipher(method, "foobar")
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		payload := append(RawAddrFromIP(net.ParseIP("192.0.2.1"), 53), "query"...)
+		pkt, err := EncryptPacket(cipher, payload)
+		if err != nil {
+			t.Fatal(method, err)
+		}
+		again, _ := EncryptPacket(cipher, payload)
+		if bytes.Equal(pkt, again) {
+			t.Error(method, "two packets got the same iv")
+		}
+		got, err := DecryptPacket(cipher, pkt)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: decrypted %q, %v", method, got, err)
+		}
+		if _, err = DecryptPacket(cipher, pkt[:cipher.info.ivLen]); err != errShortPacket {
+			t.Errorf("%s: packet of just an iv: %v", method, err)
+		}
+	}
+}
+
+func TestSplitRawAddr(t *testing.T) {
+	v4 := RawAddrFromIP(net.ParseIP("192.0.2.1"), 80)
+	v6 := RawAddrFromIP(net.ParseIP("2001:db8::1"), 443)
+	dm, _ := RawAddr("example.com:8080")
+	if len(v4) != 7 || v4[0] != 1 || len(v6) != 19 || v6[0] != 4 {
+		t.Fatalf("RawAddrFromIP gave %v and %v", v4, v6)
+	}
+	for _, addr := range [][]byte{v4, v6, dm} {
+		a, data, err := SplitRawAddr(append(append([]byte{}, addr...), "data"...))
+		if err != nil || !bytes.Equal(a, addr) || string(data) != "data" {
+			t.Errorf("split %v into %v %q, %v", addr, a, data, err)
+		}
+		// the address alone is fine, any shorter is not
+		if _, data, err = SplitRawAddr(addr); err != nil || len(data) != 0 {
+			t.Errorf("split bare %v: %q, %v", addr, data, err)
+		}
+		for n := 0; n < len(addr); n++ {
+			if _, _, err = SplitRawAddr(addr[:n]); err != errShortPacket {
+				t.Errorf("split %v truncated to %d: %v", addr, n, err)
+			}
+		}
+	}
+	// the ota flag doesn't change the address type
+	if a, _, err := SplitRawAddr(append([]byte{v4[0] | OneTimeAuthMask}, v4[1:]...)); err != nil || len(a) != 7 {
+		t.Errorf("ota flagged address: %v, %v", a, err)
+	}
+	if _, _, err := SplitRawAddr([]byte{2, 0, 0}); err == nil || err == errShortPacket {
+		t.Errorf("unknown address type: %v", err)
+	}
+}
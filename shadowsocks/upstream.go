@@ -0,0 +1,399 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnDialer opens stream connections. *net.Dialer, *Dialer and the
+// upstream proxies returned by NewUpstream all implement it. DialContext
+// gives up, handshakes with proxies included, when ctx is done.
+type ConnDialer interface {
+	Dial(network, addr string) (net.Conn, error)
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+var defaultForward ConnDialer = &net.Dialer{}
+
+// how long a handshake with a proxy may take if the context has no deadline
+const handshakeTimeout = 30 * time.Second
+
+// handshakeDeadline bounds a handshake over c by the deadline of ctx, or
+// handshakeTimeout if it has none, and aborts it when ctx is cancelled.
+// The returned function lifts the deadline once the handshake is done.
+func handshakeDeadline(ctx context.Context, c net.Conn) func() {
+	d, ok := ctx.Deadline()
+	if !ok {
+		d = time.Now().Add(handshakeTimeout)
+	}
+	c.SetDeadline(d)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		c.SetDeadline(time.Time{})
+	}
+}
+
+// NewUpstream returns a dialer that connects through an upstream proxy,
+// described by one of:
+//
+//	socks5://[user:pass@]host:port
+//	http://[user:pass@]host:port           (HTTP CONNECT)
+//	ss://method:password@host:port         (another shadowsocks server)
+//	ss://base64(method:password)@host:port (SIP002 style)
+//
+// ss urls may carry a SIP002 plugin parameter for v2ray-plugin in websocket
+// mode, e.g. ?plugin=v2ray-plugin;tls;host=example.com;path=/ws, or for
+// simple-obfs, e.g. ?plugin=obfs-local;obfs=http;obfs-host=example.com,
+// which are served by the built-in transports. The parameter may also be
+// percent-encoded, as SIP002 asks.
+//
+// The upstream itself is reached with forward, or net.Dial if nil.
+func NewUpstream(rawurl string, forward ConnDialer) (ConnDialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("upstream %s: host:port required", u.Redacted())
+	}
+	if forward == nil {
+		forward = defaultForward
+	}
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Upstream{server: u.Host, user: u.User, forward: forward}, nil
+	case "http":
+		return &httpUpstream{server: u.Host, user: u.User, forward: forward}, nil
+	case "ss":
+		method, password, err := ssUserInfo(u.User)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", u.Redacted(), err)
+		}
+		cipher, err := NewCipher(method, password)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", u.Redacted(), err)
+		}
+		d := &Dialer{cipher: cipher, server: u.Host, forward: forward}
+		plugin, err := pluginParam(u.RawQuery)
+		if err == nil {
+			err = ssPlugin(d, plugin)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", u.Redacted(), err)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("upstream %s: unsupported scheme %q", u.Redacted(), u.Scheme)
+}
+
+// pluginParam returns the plugin parameter of an ss url query. It is read
+// by hand since url.Query drops parameters holding a raw ";", as the
+// plugin often does, both escaped and unescaped forms being common.
+func pluginParam(rawQuery string) (string, error) {
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if v, ok := strings.CutPrefix(kv, "plugin="); ok {
+			plugin, err := url.PathUnescape(v)
+			if err != nil {
+				return "", fmt.Errorf("plugin parameter: %v", err)
+			}
+			return plugin, nil
+		}
+	}
+	return "", nil
+}
+
+// ssPlugin configures d according to the SIP002 plugin parameter of an ss
+// url. v2ray-plugin in websocket mode and simple-obfs are built in.
+func ssPlugin(d *Dialer, plugin string) error {
+	if plugin == "" {
+		return nil
+	}
+	opts := strings.Split(plugin, ";")
+	switch opts[0] {
+	case "v2ray-plugin":
+		ws := &WSConfig{}
+		for _, opt := range opts[1:] {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "tls":
+				ws.TLS = &tls.Config{}
+			case "host":
+				ws.Host = v
+			case "path":
+				ws.Path = v
+			case "mode":
+				if v != "websocket" {
+					return fmt.Errorf("unsupported v2ray-plugin mode %q", v)
+				}
+			}
+		}
+		d.SetWebSocket(ws)
+		return nil
+	case "obfs-local", "simple-obfs":
+		var mode, host string
+		for _, opt := range opts[1:] {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "obfs":
+				mode = v
+			case "obfs-host":
+				host = v
+			}
+		}
+		if mode == "" {
+			return errors.New("obfs-local: obfs= required")
+		}
+		return d.SetObfs(mode, host)
+	}
+	return fmt.Errorf("unsupported plugin %q", opts[0])
+}
+
+func ssUserInfo(user *url.Userinfo) (method, password string, err error) {
+	if user == nil {
+		return "", "", errors.New("method and password required")
+	}
+	method = user.Username()
+	password, ok := user.Password()
+	if !ok {
+		// SIP002 encodes method:password in url safe base64, usually
+		// without padding.
+		b, derr := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "="))
+		if derr != nil {
+			return "", "", errors.New("method and password required")
+		}
+		parts := strings.SplitN(string(b), ":", 2)
+		if len(parts) != 2 {
+			return "", "", errors.New("method and password required")
+		}
+		method, password = parts[0], parts[1]
+	}
+	return method, password, nil
+}
+
+type socks5Upstream struct {
+	server  string
+	user    *url.Userinfo
+	forward ConnDialer
+}
+
+func (s *socks5Upstream) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+func (s *socks5Upstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported connection type: %s", network)
+	}
+	c, err := s.forward.DialContext(ctx, "tcp", s.server)
+	if err != nil {
+		return nil, err
+	}
+	lift := handshakeDeadline(ctx, c)
+	err = s.handshake(c, addr)
+	lift()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 upstream %s: %v", s.server, err)
+	}
+	return c, nil
+}
+
+func (s *socks5Upstream) handshake(c net.Conn, addr string) error {
+	method := byte(0x00) // no authentication
+	if s.user != nil {
+		method = 0x02 // username/password, rfc1929
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if s.user != nil {
+		name := s.user.Username()
+		pass, _ := s.user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+	ra, err := socksAddr(addr)
+	if err != nil {
+		return err
+	}
+	if _, err = c.Write(append([]byte{5, 1, 0}, ra...)); err != nil {
+		return err
+	}
+	// VER REP RSV ATYP, then the bound address which we don't need.
+	if _, err = io.ReadFull(c, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("connect to %s failed, reply code %d", addr, buf[1])
+	}
+	var skip int
+	switch buf[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		if _, err = io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0]) + 2
+	default:
+		return fmt.Errorf("bad address type %d in reply", buf[3])
+	}
+	_, err = io.ReadFull(c, buf[:skip])
+	return err
+}
+
+// socksAddr encodes addr for a socks5 request, which shares its address
+// format with shadowsocks.
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return RawAddrFromIP(ip, port), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long: %s", host)
+	}
+	return RawAddr(addr)
+}
+
+type httpUpstream struct {
+	server  string
+	user    *url.Userinfo
+	forward ConnDialer
+}
+
+func (h *httpUpstream) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+func (h *httpUpstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, fmt.Errorf("unsupported connection type: %s", network)
+	}
+	c, err := h.forward.DialContext(ctx, "tcp", h.server)
+	if err != nil {
+		return nil, err
+	}
+	lift := handshakeDeadline(ctx, c)
+	defer lift()
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if h.user != nil {
+		pass, _ := h.user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(h.user.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err = io.WriteString(c, req); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("http upstream %s: %v", h.server, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("http upstream %s: connect to %s: %s", h.server, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The target spoke first and some of its data was read along with
+		// the response.
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Upstreams holds the named upstream proxies from the config.
+type Upstreams map[string]ConnDialer
+
+// NewUpstreams builds every upstream in urls, a map from name to url.
+func NewUpstreams(urls map[string]string, forward ConnDialer) (Upstreams, error) {
+	ups := make(Upstreams, len(urls))
+	for name, rawurl := range urls {
+		if name == RouteDirect {
+			return nil, fmt.Errorf("upstream name %q is reserved", name)
+		}
+		up, err := NewUpstream(rawurl, forward)
+		if err != nil {
+			return nil, err
+		}
+		ups[name] = up
+	}
+	return ups, nil
+}
+
+// Get returns the upstream called name. RouteDirect and "" return a nil
+// dialer, meaning no upstream.
+func (ups Upstreams) Get(name string) (ConnDialer, error) {
+	if name == "" || name == RouteDirect {
+		return nil, nil
+	}
+	up, ok := ups[name]
+	if !ok {
+		return nil, fmt.Errorf("no such upstream: %s", name)
+	}
+	return up, nil
+}
@@ -0,0 +1,191 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WSConfig describes the WebSocket transport, which carries the shadowsocks
+// stream in binary WebSocket frames, optionally inside TLS. It is wire
+// compatible with v2ray-plugin in websocket mode, so nodes can sit behind
+// ordinary reverse proxies and CDNs.
+type WSConfig struct {
+	Path string      // request path, "/" if empty
+	Host string      // Host header and TLS server name sent by clients
+	TLS  *tls.Config // nil for plain ws, e.g. behind a TLS terminating proxy
+}
+
+func (c *WSConfig) path() string {
+	if c.Path == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return "/" + c.Path
+	}
+	return c.Path
+}
+
+// wsConn is a WebSocket connection reporting the addresses of the
+// underlying connection, rather than the url based ones of websocket.Conn.
+type wsConn struct {
+	*websocket.Conn
+	raw  net.Conn
+	once sync.Once
+	done chan struct{} // closed with the connection, server side only
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.raw.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.raw.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.raw.SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.raw.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.raw.SetWriteDeadline(t) }
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	return err
+}
+
+// DialWS performs the WebSocket handshake, and the TLS one if configured,
+// over conn, which is connected to server.
+func DialWS(conn net.Conn, server string, cfg *WSConfig) (net.Conn, error) {
+	host := cfg.Host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(server)
+	}
+	scheme := "ws"
+	if cfg.TLS != nil {
+		scheme = "wss"
+		tc := cfg.TLS.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	loc := &url.URL{Scheme: scheme, Host: host, Path: cfg.path()}
+	wc, err := websocket.NewConfig(loc.String(), "http://"+host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(wc, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, raw: conn}, nil
+}
+
+type rawConnKey struct{}
+
+// wsListener accepts WebSocket connections made to an http server, which
+// serves everything that is not an upgrade on the configured path with a
+// decoy handler.
+type wsListener struct {
+	inner net.Listener
+	srv   *http.Server
+	conns chan net.Conn
+	once  sync.Once
+	err   error
+	done  chan struct{}
+}
+
+// ListenWS serves http, or https when cfg.TLS is set, on ln and returns a
+// listener yielding the WebSocket streams opened on cfg.Path. Other requests
+// are answered by decoy, a plain 404 if nil.
+func ListenWS(ln net.Listener, cfg *WSConfig, decoy http.Handler) net.Listener {
+	if decoy == nil {
+		decoy = http.NotFoundHandler()
+	}
+	l := &wsListener{
+		inner: ln,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	ws := websocket.Server{
+		// Browsers aren't the clients, any origin will do.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.handle,
+	}
+	path := cfg.path()
+	l.srv = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == path && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				ws.ServeHTTP(w, r)
+				return
+			}
+			decoy.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, rawConnKey{}, c)
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if cfg.TLS != nil {
+		l.srv.TLSConfig = cfg.TLS
+		ln = tls.NewListener(ln, cfg.TLS)
+	}
+	go func() {
+		err := l.srv.Serve(ln)
+		l.once.Do(func() {
+			l.err = err
+			close(l.done)
+		})
+	}()
+	return l
+}
+
+// handle hands the connection to Accept and keeps the handler, which owns
+// the connection, running until it is closed.
+func (l *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	raw, _ := ws.Request().Context().Value(rawConnKey{}).(net.Conn)
+	c := &wsConn{Conn: ws, raw: raw, done: make(chan struct{})}
+	select {
+	case l.conns <- c:
+		<-c.done
+	case <-l.done:
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *wsListener) Close() error {
+	err := l.srv.Close()
+	l.once.Do(func() {
+		l.err = errors.New("use of closed network connection")
+		close(l.done)
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &WSConfig{Path: "/tunnel"}
+	decoy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "welcome")
+	})
+	ln := ListenWS(inner, cfg, decoy)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	addr := inner.Addr().String()
+	resp, err := http.Get("http://" + addr + "/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "welcome" {
+		t.Errorf("plain request got %q, want the decoy", body)
+	}
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialWS(raw, addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != addr {
+		t.Errorf("remote address %v, want %v", c.RemoteAddr(), addr)
+	}
+	msg := []byte("shadowsocks stream")
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("echo %q, want %q", got, msg)
+	}
+}
+
+func TestSSPluginURL(t *testing.T) {
+	d := &Dialer{}
+	if err := ssPlugin(d, "v2ray-plugin;tls;host=cdn.example.com;path=/ws"); err != nil {
+		t.Fatal(err)
+	}
+	if d.ws == nil || d.ws.TLS == nil || d.ws.Host != "cdn.example.com" || d.ws.path() != "/ws" {
+		t.Errorf("got %+v", d.ws)
+	}
+	d = &Dialer{}
+	if err := ssPlugin(d, "obfs-local;obfs=tls;obfs-host=www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if d.obfs != ObfsTLS || d.obfsHost != "www.example.com" {
+		t.Errorf("got obfs %q host %q", d.obfs, d.obfsHost)
+	}
+	if err := ssPlugin(&Dialer{}, "kcptun;mode=fast"); err == nil {
+		t.Error("unsupported plugin accepted")
+	}
+
+	for _, rawurl := range []string{
+		"ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=v2ray-plugin;tls;host=cdn.example.com;path=/ws",
+		"ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=v2ray-plugin%3Btls%3Bhost%3Dcdn.example.com%3Bpath%3D%2Fws",
+		"ss://aes-128-cfb:foobar@127.0.0.1:8388?foo=bar&plugin=v2ray-plugin;tls;host=cdn.example.com;path=/ws",
+	} {
+		up, err := NewUpstream(rawurl, nil)
+		if err != nil {
+			t.Fatal(rawurl, err)
+		}
+		d := up.(*Dialer)
+		if d.ws == nil || d.ws.TLS == nil || d.ws.Host != "cdn.example.com" || d.ws.path() != "/ws" {
+			t.Errorf("%s: got %+v", rawurl, d.ws)
+		}
+	}
+	if _, err := NewUpstream("ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=v2ray-plugin%3", nil); err == nil {
+		t.Error("accepted a badly escaped plugin")
+	}
+	if _, err := NewUpstream("ss://aes-128-cfb:foobar@127.0.0.1:8388/?plugin=kcptun;mode=fast", nil); err == nil {
+		t.Error("accepted an unsupported plugin")
+	}
+}
@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+)
+
+// Estimates of what the kernel adds to the bytes of a tcp connection: ip
+// and tcp headers with the timestamp option, and segments of the mss left
+// over from a 1500 byte mtu.
+const (
+	tcpHeader4 = 20 + 32
+	tcpHeader6 = 40 + 32
+	udpHeader4 = 20 + 8
+	udpHeader6 = 40 + 8
+	wireMTU    = 1500
+)
+
+// WireConn counts the bytes read from and written to a client connection,
+// and an estimate of the tcp/ip packets carrying them, as wire traffic of
+// its port. Everything above it, the iv, ota headers, AEAD tags and
+// transport framing, is included.
+type WireConn struct {
+	net.Conn
+	stat *PortStats
+	hdr  int // ip and tcp header length
+	mss  int
+	once sync.Once
+}
+
+// NewWireConn wraps c, counting its traffic for port. The handshake
+// packets are counted at once.
+func NewWireConn(c net.Conn, port string) *WireConn {
+	w := &WireConn{Conn: c, stat: Stats.Get(port), hdr: tcpHeader4}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+		w.hdr = tcpHeader6
+	}
+	w.mss = wireMTU - w.hdr
+	// SYN and ACK in, SYN-ACK out
+	w.stat.addWire(int64(2*w.hdr), int64(w.hdr))
+	return w
+}
+
+// packets returns the packets needed to carry n bytes.
+func (c *WireConn) packets(n int) int {
+	return (n + c.mss - 1) / c.mss
+}
+
+// Received data is acknowledged every second packet.
+func (c *WireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		p := c.packets(n)
+		c.stat.addWire(int64(n+p*c.hdr), int64((p+1)/2*c.hdr))
+	}
+	return n, err
+}
+
+func (c *WireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		p := c.packets(n)
+		c.stat.addWire(int64((p+1)/2*c.hdr), int64(n+p*c.hdr))
+	}
+	return n, err
+}
+
+// Close counts the FIN and ACK each side sends.
+func (c *WireConn) Close() error {
+	c.once.Do(func() {
+		c.stat.addWire(int64(2*c.hdr), int64(2*c.hdr))
+	})
+	return c.Conn.Close()
+}
+
+// NetConn returns the connection traffic is counted for.
+func (c *WireConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type wireListener struct {
+	net.Listener
+	port string
+}
+
+// NewWireListener returns a listener whose connections are WireConns
+// counting traffic for port.
+func NewWireListener(ln net.Listener, port string) net.Listener {
+	return &wireListener{ln, port}
+}
+
+func (l *wireListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewWireConn(c, l.port), nil
+}
+
+// AddPacketWire counts a udp datagram of n bytes from or to addr as wire
+// traffic of port, received if in is true.
+func AddPacketWire(port string, addr net.Addr, n int, in bool) {
+	hdr := udpHeader4
+	if a, ok := addr.(*net.UDPAddr); ok && a.IP.To4() == nil {
+		hdr = udpHeader6
+	}
+	if in {
+		addWire(port, int64(n+hdr), 0)
+	} else {
+		addWire(port, 0, int64(n+hdr))
+	}
+}
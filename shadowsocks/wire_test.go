@@ -0,0 +1,48 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWireConn(t *testing.T) {
+	Stats = NewStatsRegistry()
+	stat := Stats.Add("8388")
+	server, client := net.Pipe()
+	c := NewWireConn(server, "8388")
+	if stat.ue != 2*tcpHeader4 || stat.de != tcpHeader4 {
+		t.Fatalf("handshake counted as %d/%d", stat.ue, stat.de)
+	}
+
+	go client.Write(make([]byte, 3000))
+	buf := make([]byte, 3000)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	// 3000 bytes take three packets, however they were read
+	if stat.ue < 2*tcpHeader4+3000+3*tcpHeader4 {
+		t.Errorf("received %d bytes on the wire, want at least %d", stat.ue, 2*tcpHeader4+3000+3*tcpHeader4)
+	}
+
+	// The payload comes off the wire traffic, leaving the overhead.
+	stat.ue = 0
+	stat.de = 0
+	go io.ReadFull(client, buf[:100])
+	if _, err := c.Write(buf[:100]); err != nil {
+		t.Fatal(err)
+	}
+	updateD("8388", 100)
+	if tr := stat.traffic(); tr.D != 100 || tr.De != tcpHeader4 || tr.Ue != tcpHeader4 {
+		t.Errorf("D %d overhead %d/%d, want 100 and %d/%d", tr.D, tr.Ue, tr.De, tcpHeader4, tcpHeader4)
+	}
+
+	// Payload counted before its wire traffic bills no negative overhead.
+	stat.ue = 0
+	updateU("8388", 10)
+	if tr := stat.traffic(); tr.Ue != 0 || stat.ue != -10 {
+		t.Errorf("overhead %d with ue %d, want 0 with -10", tr.Ue, stat.ue)
+	}
+	c.Close()
+	client.Close()
+}